@@ -0,0 +1,27 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBase58RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"no leading zeros", []byte{0x01, 0x02}, "5T"},
+		{"version byte", []byte{0x00, 0x01, 0x02}, "15T"},
+		{"hash that starts with zeros", []byte{0x00, 0x00, 0x00, 0x01, 0x02}, "1115T"},
+	}
+	for _, tt := range tests {
+		encoded := Base58Encode(tt.input)
+		if string(encoded) != tt.want {
+			t.Errorf("%s: encoded to %s, want %s", tt.name, encoded, tt.want)
+		}
+		if decoded := Base58Decode(encoded); !bytes.Equal(decoded, tt.input) {
+			t.Errorf("%s: decoded to %x, want %x", tt.name, decoded, tt.input)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package block
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
-	"os"
 	"time"
 )
 
@@ -12,58 +12,73 @@ const (
 	targetBits          = 15
 	dbFile              = "blocks.db"
 	blocksBucket        = "blockBucket"
-	subsidy             = 10
 	genesisCoinbaseData = "Genesis block for ACN"
 	addressChecksumLen  = 4
 	// version setting
 	version    = byte(0x00)
 	walletFile = "wallet.dat"
 	walletChecksumLen = 4
+	// keyPartLength is the length of each half of a public key or a signature, the size of a P256 number.
+	keyPartLength = 32
 )
 
-// TODO: implement block height
 // Block represents a single block withing a blockchain. A block contains headers, and the body (transactions). A block always references the previous block in a chain.
 type Block struct {
-	Timestamp     int64
-	Transactions  []*Transaction
-	PrevBlockHash []byte
-	Hash          []byte
-	Nonce         int
-	Height        int
+	BlockHeader
+	Transactions []*Transaction
 }
 
 // NewGenesisBlock creates a new genesis block. The genesis block is the initial block created when a blockchain is created.
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, initialBits)
 }
 
-// NewBlock takes in a list of transactions, and the previous blocks hash, and creates a new block.
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{
-		Timestamp:     time.Now().Unix(),
-		Transactions:  transactions,
-		PrevBlockHash: prevBlockHash,
-		Hash:          []byte{},
-		Nonce:         0,
-		Height:        height,
-	}
+// NewBlock takes in a list of transactions, the previous blocks hash, and the target in compact form, and creates a new block.
+// The target has to be the one NextBits returns for the previous block, otherwise other nodes won't accept the block.
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32) *Block {
+	block, _ := NewBlockContext(context.Background(), transactions, prevBlockHash, height, bits)
+	return block
+}
 
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+// NewBlockContext creates a new block just like NewBlock, but stops mining and returns an error once ctx is cancelled.
+func NewBlockContext(ctx context.Context, transactions []*Transaction, prevBlockHash []byte, height int, bits uint32) (*Block, error) {
+	block := newBlockTemplate(transactions, prevBlockHash, height, bits)
+
+	err := NewMiner(0, nil).Mine(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+// newBlockTemplate creates a block that's ready to be mined. Its nonce and hash are set by Miner.Mine.
+func newBlockTemplate(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:       blockVersion,
+			PrevBlockHash: prevBlockHash,
+			Timestamp:     time.Now().Unix(),
+			Bits:          bits,
+			Hash:          []byte{},
+			Height:        height,
+		},
+		Transactions: transactions,
+	}
+	// the merkle root is worked out once here, mining only changes it when it runs out of nonces
+	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
 // HashTransactions joins together a slice of transaction ID's, and hashes them together. Used when preparing a blocks data.
 // Notice the merkle tree. Instead of saving all transactions and hashing them together, we use a merkle tree instead.
+// The tree is built from the ID's and not the serialized transactions, since gob doesn't encode a transaction to the same bytes in every
+// process, and every node has to come up with the same merkle root for a block.
 func (b *Block) HashTransactions() []byte {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		transactions = append(transactions, tx.ID)
 	}
 
 	mTree := NewMerkleTree(transactions)
@@ -83,17 +98,27 @@ func (b *Block) Serialize() []byte {
 	return result.Bytes()
 }
 
-// Deserialize decodes a serialized block
+// Deserialize decodes a serialized block. It's only meant for blocks read from our own db, which are always valid, so it panics if it can't
+// decode one. Blocks from other nodes are decoded with decodeBlock.
 func DeserializeBlock(d []byte) *Block {
+	block, err := decodeBlock(d)
+	if err != nil {
+		panic(err)
+	}
+
+	return block
+}
+
+// decodeBlock decodes a serialized block, returning an error if it can't.
+func decodeBlock(d []byte) (*Block, error) {
 	var block Block
 
 	decoder := gob.NewDecoder(bytes.NewReader(d))
 	// decode d into block
 	err := decoder.Decode(&block)
 	if err != nil {
-		fmt.Println("error decoding block", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error decoding block: %s", err)
 	}
 
-	return &block
+	return &block, nil
 }
@@ -2,6 +2,7 @@ package block
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
@@ -9,12 +10,23 @@ import (
 	"github.com/boltdb/bolt"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
+// dbOpenTimeout is how long to wait for another process to let go of the db file, before giving up.
+const dbOpenTimeout = 5 * time.Second
+
+// errStaleTip is returned when a mined block no longer builds on the tail of the chain, because another block was added in the meantime.
+var errStaleTip = errors.New("block was mined on top of an old tip")
+
 // Blockchain represents an entire blockchain. It stores the tip/tail/(hash of the last block) in a blockchain.
 type Blockchain struct {
-	Tip []byte // Tip is the hash of the latest block added to the blockchain
+	Tip []byte // Tip is the hash of the latest block added to the blockchain. Use TipHash to read it when other goroutines may be adding blocks.
 	DB  *bolt.DB // DB is a reference to a boltDB connection
+	DataDir string // DataDir is the directory the db and wallets are stored in
+
+	mu sync.RWMutex // mu guards Tip
 }
 
 // BlockchainIterator stores the current hash of the block you are about to iterate over
@@ -23,22 +35,27 @@ type BlockchainIterator struct {
 	DB          *bolt.DB // DB is a reference to a boltDB connection
 }
 
-// CreateBlockchain creates a blockchain. It first creates a genesis block, and signs the output with the address of the creator.
-func CreateBlockchain(address string) *Blockchain {
-	if DBExists() {
+// CreateBlockchain creates a blockchain in dataDir. It first creates a genesis block, and signs the output with the address of the creator.
+func CreateBlockchain(address, dataDir string) *Blockchain {
+	if DBExists(dataDir) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 
 	var tip []byte
 
-	db, err := bolt.Open(dbFile, 0600, nil)
+	err := os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := bolt.Open(dbPath(dataDir), 0600, nil)
 	if err != nil {
 		panic(err)
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+		cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 		genesis := NewGenesisBlock(cbtx)
 
 		b, err := tx.CreateBucket([]byte(blocksBucket))
@@ -49,7 +66,11 @@ func CreateBlockchain(address string) *Blockchain {
 		if err != nil {
 			panic(err)
 		}
-		err = b.Put([]byte("l"), genesis.Hash)
+		err = putTip(tx, genesis.Hash)
+		if err != nil {
+			panic(err)
+		}
+		_, err = storeHeader(tx, genesis.Header())
 		if err != nil {
 			panic(err)
 		}
@@ -65,89 +86,207 @@ func CreateBlockchain(address string) *Blockchain {
 	return &Blockchain{
 		Tip: tip,
 		DB:  db,
+		DataDir: dataDir,
 	}
 }
 
-// NewBlockChain doesn't create a blockchain, instead it identifies the tail of a previous blockchain, and that becomes the starting point of the new blockchain.
-func NewBlockChain(nodeID string) *Blockchain {
-	if !DBExists() {
+// NewBlockChain doesn't create a blockchain, instead it opens the blockchain stored in dataDir, and its tail becomes the starting point of the new blockchain.
+func NewBlockChain(dataDir string) *Blockchain {
+	if !DBExists(dataDir) {
 		fmt.Println("No existing blockchain found. Please create one first.")
 		os.Exit(1)
 	}
 
+	bc, err := OpenBlockchain(dataDir)
+	if err != nil {
+		panic(err)
+	}
+	return bc
+}
+
+// OpenBlockchain opens the blockchain stored in dataDir like NewBlockChain does, but returns an error instead of exiting when something goes wrong.
+// It's meant for code that embeds a node, and can't have the whole process exit.
+func OpenBlockchain(dataDir string) (*Blockchain, error) {
+	if !DBExists(dataDir) {
+		return nil, errors.New("no existing blockchain found in " + dataDir)
+	}
+
 	var tip []byte
 
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dbPath(dataDir), 0600, &bolt.Options{Timeout: dbOpenTimeout})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	var reindex, indexHeights bool
+	err = db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		if b == nil {
+			return errors.New("db has no blocks bucket")
+		}
+		// bolt's values are only valid during the transaction, so keep a copy
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+		reindex = !hasUTXOSet(tx) || !utxoSetAtTip(tx)
+		indexHeights = !hasHeightIndex(tx)
 		return nil
 	})
 	if err != nil {
-		panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	return &Blockchain{
+	// chains created before the height index have to build it, from the tail back to genesis
+	if indexHeights {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return putTip(tx, tip)
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	bc := &Blockchain{
 		Tip: tip,
 		DB:  db,
+		DataDir: dataDir,
+	}
+
+	// chains created before the UTXO set was keyed by outpoint need a new one, and so does a set that was left behind the tail
+	if reindex {
+		fmt.Println("Rebuilding the UTXO set")
+		UTXOSet{Blockchain: bc}.Reindex()
 	}
+	return bc, nil
 }
 
 // MineBlock takes in a list of transactions, finds the last hash of a blockchain, and creates a new block with the transactions and last hash.
-// Then it updates the db and inserts the block, and updates the tail to be the hash of this new block.
+// Then it updates the db and inserts the block, connects it to the UTXO set, and updates the tail to be the hash of this new block.
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var (
-		lastHash []byte
-		lastHeight int
-	)
-
 	for _, tx := range transactions {
 		if !bc.VerifyTransaction(tx) {
 			log.Panic("ERROR: Invalid transaction")
 		}
 	}
 
-	err := bc.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-		serializedBlock := b.Get(lastHash)
-		lastHeight = DeserializeBlock(serializedBlock).Height
-		return nil
-	})
+	lastHash, lastHeight := bc.lastBlock()
+
+	newBlock, err := bc.blockTemplate(transactions, lastHash, lastHeight)
+	if err != nil {
+		panic(err)
+	}
+	err = NewMiner(0, nil).Mine(context.Background(), newBlock)
 	if err != nil {
 		panic(err)
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+	err = bc.AppendBlock(newBlock)
+	if err != nil {
+		panic(err)
+	}
+
+	return newBlock
+}
+
+// AppendBlock validates a freshly mined block, inserts it into the db, connects it to the UTXO set, and makes it the new tail. It's all done in a
+// single db transaction, so the block, the tail and the UTXO set always move together. The block must have been mined on top of the current
+// tail. If another block was added while this one was being mined, errStaleTip is returned and nothing is stored. A block that fails
+// validation returns its error, and nothing is stored either.
+func (bc *Blockchain) AppendBlock(newBlock *Block) error {
+	err := checkBlockSanity(newBlock); if err != nil {
+		return err
+	}
 
 	err = bc.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
+		if !bytes.Equal(b.Get([]byte("l")), newBlock.PrevBlockHash) {
+			return errStaleTip
+		}
+
+		err := checkBlockOnTip(tx, newBlock)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		err = b.Put([]byte("l"), newBlock.Hash)
+
+		_, err = storeHeader(tx, newBlock.Header())
 		if err != nil {
-			panic(err)
+			return err
+		}
+
+		err = b.Put(newBlock.Hash, newBlock.Serialize())
+		if err != nil {
+			return err
+		}
+		err = connectBlock(tx, newBlock)
+		if err != nil {
+			return err
 		}
-		bc.Tip = newBlock.Hash
+		return putTip(tx, newBlock.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.setTip(newBlock.Hash)
+	return nil
+}
+
+// blockTemplate creates a block out of transactions that builds on the block lastHash at lastHeight, and is ready to be mined. Its target and
+// timestamp are the ones other nodes expect it to have.
+func (bc *Blockchain) blockTemplate(transactions []*Transaction, lastHash []byte, lastHeight int) (*Block, error) {
+	bits, err := bc.NextBits(lastHash)
+	if err != nil {
+		return nil, err
+	}
+	minTime, err := bc.MinTimestamp(lastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	block := newBlockTemplate(transactions, lastHash, lastHeight+1, bits)
+	if block.Timestamp < minTime {
+		block.Timestamp = minTime
+	}
+	return block, nil
+}
+
+// lastBlock returns the hash and height of the tail of the chain.
+func (bc *Blockchain) lastBlock() ([]byte, int) {
+	var (
+		lastHash []byte
+		lastHeight int
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
+		serializedBlock := b.Get(lastHash)
+		lastHeight = DeserializeBlock(serializedBlock).Height
 		return nil
 	})
 	if err != nil {
 		panic(err)
 	}
+	return lastHash, lastHeight
+}
 
-	return newBlock
+// TipHash returns the hash of the latest block. It's safe to call while other goroutines are adding blocks.
+func (bc *Blockchain) TipHash() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.Tip
+}
+
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.Tip = hash
 }
 
 // Iterator returns an iterator for a Blockchain
 func (bc *Blockchain) Iterator() *BlockchainIterator {
 	return &BlockchainIterator{
-		currentHash: bc.Tip,
+		currentHash: bc.TipHash(),
 		DB:          bc.DB,
 	}
 }
@@ -172,8 +311,23 @@ func (i *BlockchainIterator) Next() *Block {
 	return block
 }
 
-// FindTransaction finds a specific transaction across the entire blockchain by its ID.
+// FindTransaction finds a specific transaction on the main chain by its ID. It's a single lookup when the transaction index is on, otherwise
+// every block is read from the tail back, until the transaction is found.
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	var (
+		found   Transaction
+		indexed bool
+	)
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		found, indexed, err = findIndexedTransaction(tx, ID)
+		return err
+	})
+	if indexed {
+		return found, err
+	}
+
 	bci := bc.Iterator()
 
 	for {
@@ -218,15 +372,15 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 
 	for _, vin := range tx.Vin {
 		prevTX, err := bc.FindTransaction(vin.Txid); if err != nil {
-			// properly handle this error. Return an err if you can't find anything
-			fmt.Println(err)
+			// a transaction that spends from a transaction that doesn't exist is invalid
+			return false
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 	return tx.Verify(prevTXs)
 }
 
-func (bc Blockchain) GetBestHeight() int {
+func (bc *Blockchain) GetBestHeight() int {
 	var bestHeight int
 
 	err := bc.DB.View(func(tx *bolt.Tx) error {
@@ -241,17 +395,18 @@ func (bc Blockchain) GetBestHeight() int {
 	return bestHeight
 }
 
-func (bc Blockchain) GetBlockHashes() [][]byte {
-	var blockHashes [][]byte
-	itr := bc.Iterator()
-
-	for {
-		blk := itr.Next()
+// GetBlock finds a block by its hash. The block doesn't have to be on the main chain, see GetBlockByHeight for that.
+func (bc *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
 
-		blockHashes = append(blockHashes, blk.Hash)
-		if len(blk.PrevBlockHash) == 0 {
-			break
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		encBlock := b.Get(hash)
+		if encBlock == nil {
+			return errors.New("block not found")
 		}
-	}
-	return blockHashes
-}
\ No newline at end of file
+		block = DeserializeBlock(encBlock)
+		return nil
+	})
+	return block, err
+}
@@ -0,0 +1,15 @@
+package block
+
+// Config holds everything a node needs to know when it's started.
+type Config struct {
+	NodeID       string   // NodeID is the port the node listens on, i.e "3000".
+	DataDir      string   // DataDir is the directory the node's chain, UTXO set, wallets and known peers are stored in. Every node needs its own.
+	MinerAddress string   // MinerAddress is the address mining rewards are sent to. Leave it empty for a node that doesn't mine.
+	Seeds        []string // Seeds are addresses of nodes to connect to, on top of the peers stored from previous runs.
+	MaxOutbound  int      // MaxOutbound is the number of outbound peers the node tries to keep. Zero means defaultOutboundPeers.
+	MempoolSize  int      // MempoolSize is the most bytes of transactions the mempool holds. Zero means defaultMempoolSize.
+	MinerThreads int      // MinerThreads is the number of goroutines that mine. Zero means one per core.
+
+	// OnHashrate is called with the miner's hashes per second every few seconds while a block is being mined. It can be nil.
+	OnHashrate func(hashesPerSecond float64)
+}
@@ -0,0 +1,127 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+// The difficulty isn't fixed. Every block stores the target its hash had to be below, in the compact Bits format. Every retargetInterval blocks
+// the target is adjusted, based on how long the last retargetInterval blocks actually took to mine, compared to how long they should have taken
+// at targetBlockSpacing per block. If they took half the time, the target is halved, which makes blocks twice as hard to mine. The adjustment
+// is clamped to maxRetargetFactor either way, so that a few blocks with odd timestamps can't swing the difficulty too far at once.
+
+const (
+	// retargetInterval is how many blocks go by between difficulty adjustments.
+	retargetInterval = 20
+	// targetBlockSpacing is how many seconds a block should take to mine, on average.
+	targetBlockSpacing = 30
+	// maxRetargetFactor is the most the target can grow or shrink in a single adjustment.
+	maxRetargetFactor = 4
+	// minDifficultyBits is the difficulty of the easiest target allowed, 2^(256-minDifficultyBits).
+	minDifficultyBits = 8
+)
+
+var (
+	// initialBits is the target of the genesis block, and every block up to the first adjustment.
+	initialBits = BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-targetBits))
+	// powLimit is the easiest target allowed. The target never grows past it, no matter how slow blocks are.
+	powLimit = new(big.Int).Lsh(big.NewInt(1), 256-minDifficultyBits)
+
+	errBadBits = errors.New("block's target isn't the expected target")
+)
+
+// Target returns the target the header's hash has to be below.
+func (h BlockHeader) Target() *big.Int {
+	return CompactToBig(h.Bits)
+}
+
+// NextBits returns the target, in compact form, that a block built on top of prevHash has to use.
+func (bc *Blockchain) NextBits(prevHash []byte) (uint32, error) {
+	var bits uint32
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		if len(prevHash) == 0 {
+			bits = initialBits
+			return nil
+		}
+
+		parent, err := getHeader(tx, prevHash)
+		if err != nil {
+			return err
+		}
+		bits, err = nextBits(tx, parent)
+		return err
+	})
+	return bits, err
+}
+
+// nextBits works out the target of the block after parent. Unless that block starts a new retarget interval, it's the same as parent's.
+func nextBits(tx *bolt.Tx, parent BlockHeader) (uint32, error) {
+	if (parent.Height+1)%retargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	// walk back to the last block of the previous interval, or genesis for the first one
+	first := parent
+	for i := 0; i < retargetInterval && len(first.PrevBlockHash) > 0; i++ {
+		var err error
+		first, err = getHeader(tx, first.PrevBlockHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	expected := int64(parent.Height-first.Height) * targetBlockSpacing
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/maxRetargetFactor {
+		actual = expected / maxRetargetFactor
+	}
+	if actual > expected*maxRetargetFactor {
+		actual = expected * maxRetargetFactor
+	}
+
+	// newTarget = oldTarget * actual / expected
+	newTarget := new(big.Int).Mul(parent.Target(), big.NewInt(actual))
+	newTarget.Div(newTarget, big.NewInt(expected))
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+
+	return BigToCompact(newTarget), nil
+}
+
+// CompactToBig decodes a target from the compact Bits format. The top byte is the length of the target in bytes, and the low 3 bytes are its
+// most significant bytes. It's the same format bitcoin uses. Compact targets are never negative, so the sign bit is ignored.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+	return new(big.Int).Lsh(big.NewInt(mantissa), 8*(exponent-3))
+}
+
+// BigToCompact encodes a target in the compact Bits format. Only the 3 most significant bytes are kept, so the target is rounded down.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() <= 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+
+	// the top bit of the mantissa is the sign bit, so move everything a byte over if it's set
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
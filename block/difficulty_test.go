@@ -0,0 +1,150 @@
+package block
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string // target is in hex
+	}{
+		{0x01120000, "12"},
+		{0x02008000, "80"},
+		{0x05009234, "92340000"},
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{initialBits, new(big.Int).Lsh(big.NewInt(1), 256-targetBits).Text(16)},
+		{BigToCompact(powLimit), powLimit.Text(16)},
+	}
+	for _, tt := range tests {
+		want, _ := new(big.Int).SetString(tt.target, 16)
+		if got := CompactToBig(tt.compact); got.Cmp(want) != 0 {
+			t.Errorf("CompactToBig(%#08x) = %x, want %x", tt.compact, got, want)
+		}
+		if got := BigToCompact(want); got != tt.compact {
+			t.Errorf("BigToCompact(%x) = %#08x, want %#08x", want, got, tt.compact)
+		}
+	}
+
+	// only the 3 most significant bytes are kept, so a target is rounded down
+	n, _ := new(big.Int).SetString("123456789", 16)
+	if got := CompactToBig(BigToCompact(n)); got.Text(16) != "123450000" {
+		t.Errorf("%x went through the compact format as %x, want 123450000", n, got)
+	}
+	if BigToCompact(big.NewInt(0)) != 0 || BigToCompact(big.NewInt(-1)) != 0 {
+		t.Error("a target that isn't positive doesn't encode to 0")
+	}
+}
+
+// storeHeaderChain stores a chain of headers with the given timestamps and bits, genesis first, in a fresh db, and returns the headers. Only
+// what nextBits needs is filled in. done closes and deletes the db.
+func storeHeaderChain(t *testing.T, bits uint32, timestamps []int64) (db *bolt.DB, headers []BlockHeader, done func()) {
+	dir, err := ioutil.TempDir("", "acoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bolt.Open(filepath.Join(dir, "headers.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done = func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		var prev []byte
+		for height, ts := range timestamps {
+			hash := make([]byte, 8)
+			binary.BigEndian.PutUint64(hash, uint64(height+1))
+
+			h := BlockHeader{Height: height, PrevBlockHash: prev, Hash: hash, Timestamp: ts, Bits: bits}
+			_, err := storeHeader(tx, h)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, h)
+			prev = hash
+		}
+		return nil
+	})
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+	return db, headers, done
+}
+
+// evenTimestamps returns count timestamps spacing seconds apart.
+func evenTimestamps(count int, spacing int64) []int64 {
+	var timestamps []int64
+	for i := 0; i < count; i++ {
+		timestamps = append(timestamps, 1600000000+int64(i)*spacing)
+	}
+	return timestamps
+}
+
+// twoIntervals returns the timestamps of two retarget intervals, the first with blocks first seconds apart, and the second with blocks second
+// seconds apart.
+func twoIntervals(first, second int64) []int64 {
+	timestamps := evenTimestamps(retargetInterval, first)
+	last := timestamps[len(timestamps)-1]
+	for i := 1; i <= retargetInterval; i++ {
+		timestamps = append(timestamps, last+int64(i)*second)
+	}
+	return timestamps
+}
+
+func TestNextBits(t *testing.T) {
+	target := CompactToBig(initialBits)
+	// scale returns the target times num/den, in compact form
+	scale := func(target *big.Int, num, den int64) uint32 {
+		n := new(big.Int).Mul(target, big.NewInt(num))
+		return BigToCompact(n.Div(n, big.NewInt(den)))
+	}
+
+	// the first interval goes back to genesis, so it's one block short
+	firstExpected := int64(retargetInterval-1) * targetBlockSpacing
+
+	tests := []struct {
+		name       string
+		bits       uint32
+		timestamps []int64
+		want       uint32
+	}{
+		{"not a retarget height", initialBits, evenTimestamps(retargetInterval-5, 1), initialBits},
+		{"on time", initialBits, evenTimestamps(retargetInterval, targetBlockSpacing), initialBits},
+		{"twice as fast", initialBits, evenTimestamps(retargetInterval, targetBlockSpacing/2), scale(target, 1, 2)},
+		{"twice as slow", initialBits, evenTimestamps(retargetInterval, targetBlockSpacing*2), scale(target, 2, 1)},
+		{"too fast is clamped", initialBits, evenTimestamps(retargetInterval, 0), scale(target, firstExpected/maxRetargetFactor, firstExpected)},
+		{"too slow is clamped", initialBits, evenTimestamps(retargetInterval, targetBlockSpacing*100), scale(target, maxRetargetFactor, 1)},
+		{"never easier than powLimit", BigToCompact(powLimit), evenTimestamps(retargetInterval, targetBlockSpacing*2), BigToCompact(powLimit)},
+		// the second interval only looks at its own blocks, which were twice as fast
+		{"second interval", initialBits, twoIntervals(targetBlockSpacing*3, targetBlockSpacing/2), scale(target, 1, 2)},
+	}
+	for _, tt := range tests {
+		db, headers, done := storeHeaderChain(t, tt.bits, tt.timestamps)
+		parent := headers[len(headers)-1]
+
+		var got uint32
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			got, err = nextBits(tx, parent)
+			return err
+		})
+		done()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: nextBits after height %d = %#08x, want %#08x", tt.name, parent.Height, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// blockVersion is the version of the block format. It's part of every header, so that the format can change later on.
+	blockVersion = 1
+	// headerLength is the length of a header in its fixed layout, see Bytes.
+	headerLength = 4 + 32 + 32 + 8 + 4 + 4
+	// headerNonceOffset is where the nonce sits in the fixed layout. Mining only rewrites these 4 bytes between attempts.
+	headerNonceOffset = headerLength - 4
+)
+
+// BlockHeader is everything about a block except for its transactions. The transactions are summed up by the merkle root, so a header is enough
+// to check a block's proof of work, without downloading the whole block. That's what lets a node sync the headers of a long chain first, and
+// reject a bogus chain before downloading any of its blocks.
+// A block's hash is the hash of its header alone, laid out in a fixed number of bytes (see Bytes). Hash and Height aren't part of that layout,
+// they're kept alongside the header so that it can be stored and sent on its own.
+type BlockHeader struct {
+	Version       uint32
+	PrevBlockHash []byte
+	MerkleRoot    []byte // MerkleRoot is the root of the merkle tree of the block's transactions. See HashTransactions.
+	Timestamp     int64
+	Bits          uint32 // Bits is the target the block's hash has to be below, in compact form. See CompactToBig.
+	Nonce         uint32
+
+	Hash   []byte
+	Height int
+}
+
+// Header returns the header of a block.
+func (b *Block) Header() BlockHeader {
+	return b.BlockHeader
+}
+
+// Bytes lays out the header in headerLength bytes: version, previous hash, merkle root, timestamp, bits and nonce, one after the other, with
+// numbers in big endian. The genesis block has no previous hash, so those bytes are left zero. This is what gets hashed, both when mining and
+// when checking a block.
+func (h *BlockHeader) Bytes() []byte {
+	data := make([]byte, headerLength)
+
+	binary.BigEndian.PutUint32(data[0:4], h.Version)
+	copy(data[4:36], h.PrevBlockHash)
+	copy(data[36:68], h.MerkleRoot)
+	binary.BigEndian.PutUint64(data[68:76], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(data[76:80], h.Bits)
+	binary.BigEndian.PutUint32(data[headerNonceOffset:], h.Nonce)
+
+	return data
+}
+
+// ComputeHash hashes the header's fixed layout.
+func (h *BlockHeader) ComputeHash() []byte {
+	hash := sha256.Sum256(h.Bytes())
+	return hash[:]
+}
+
+// ValidatePoW checks that the header's hash is really the hash of its data, and that it's below the header's target. It doesn't check that the
+// target is the one the header should have used, that's up to whoever adds the header to the chain.
+func (h BlockHeader) ValidatePoW() bool {
+	var hashInt big.Int
+
+	hash := h.ComputeHash()
+	if !bytes.Equal(hash, h.Hash) {
+		return false
+	}
+	hashInt.SetBytes(hash)
+
+	target := h.Target()
+	return target.Sign() > 0 && target.Cmp(powLimit) <= 0 && hashInt.Cmp(target) == -1
+}
+
+// Serialize encodes a header to be stored in the headersBucket. Unlike Bytes, it includes the hash and height.
+func (h BlockHeader) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(h); if err != nil {
+		fmt.Println("error serializing header", err)
+	}
+	return buff.Bytes()
+}
+
+// DeserializeHeader decodes a serialized header.
+func DeserializeHeader(data []byte) (BlockHeader, error) {
+	var h BlockHeader
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&h)
+	return h, err
+}
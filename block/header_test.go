@@ -0,0 +1,85 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHeaderBytes(t *testing.T) {
+	h := BlockHeader{
+		Version:       blockVersion,
+		PrevBlockHash: bytes.Repeat([]byte{0xaa}, 32),
+		MerkleRoot:    bytes.Repeat([]byte{0xbb}, 32),
+		Timestamp:     0x0102030405060708,
+		Bits:          0x1d00ffff,
+		Nonce:         0xdeadbeef,
+		Hash:          []byte{1, 2, 3},
+		Height:        42,
+	}
+
+	want := "00000001" + // version
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" + // previous hash
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" + // merkle root
+		"0102030405060708" + // timestamp
+		"1d00ffff" + // bits
+		"deadbeef" // nonce
+
+	data := h.Bytes()
+	if len(data) != 84 || headerLength != 84 {
+		t.Fatalf("header is %d bytes, and headerLength is %d, want 84", len(data), headerLength)
+	}
+	if got := hex.EncodeToString(data); got != want {
+		t.Errorf("header bytes are\n%s\nwant\n%s", got, want)
+	}
+
+	// the hash and height aren't part of the layout
+	other := h
+	other.Hash, other.Height = nil, 7
+	if !bytes.Equal(other.Bytes(), data) {
+		t.Error("the hash or height changed the header's bytes")
+	}
+
+	// genesis has no previous hash, so those bytes are zero
+	h.PrevBlockHash = nil
+	if !bytes.Equal(h.Bytes()[4:36], make([]byte, 32)) {
+		t.Error("a header without a previous hash doesn't have zeros in its place")
+	}
+}
+
+func TestHeaderHashRoundTrip(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	blk := c.mine(t, nil, 0, nil)
+	h := blk.Header()
+	if !bytes.Equal(h.ComputeHash(), blk.Hash) || !h.ValidatePoW() {
+		t.Fatal("a mined block's hash isn't the hash of its header")
+	}
+
+	stored, err := DeserializeHeader(h.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Bytes(), h.Bytes()) || !bytes.Equal(stored.ComputeHash(), blk.Hash) || stored.Height != blk.Height {
+		t.Error("the header changed going through Serialize and DeserializeHeader")
+	}
+	if !stored.ValidatePoW() {
+		t.Error("a header's proof of work isn't valid after DeserializeHeader")
+	}
+
+	fromBlock := DeserializeBlock(blk.Serialize()).Header()
+	if !bytes.Equal(fromBlock.ComputeHash(), blk.Hash) {
+		t.Error("the header's hash changed going through the block's Serialize and DeserializeBlock")
+	}
+	if !bytes.Equal(NewProofOfWork(blk).PrepareData(blk.Nonce), h.Bytes()) {
+		t.Error("mining hashes different bytes than the header's layout")
+	}
+
+	// the nonce is part of what gets hashed
+	tampered := stored
+	tampered.Nonce++
+	if bytes.Equal(tampered.ComputeHash(), blk.Hash) || tampered.ValidatePoW() {
+		t.Error("changing the nonce didn't change the hash")
+	}
+}
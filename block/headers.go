@@ -0,0 +1,282 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// headersBucket stores every header we know about, keyed by the block's hash. The headers of blocks we have are in there too. The "l" key
+	// holds the hash of the header with the most cumulative work, which can be ahead of the tail of the blockchain while blocks are downloading.
+	headersBucket = "headersBucket"
+	// maxHeadersPerMessage is the most headers sent in a single headers message.
+	maxHeadersPerMessage = 2000
+)
+
+var errBadPoW = errors.New("header's proof of work is invalid")
+
+// AddHeaders validates a batch of headers received from another node and stores them in order, in a single db transaction. Each header's parent
+// has to be known and valid, its height, target and timestamp have to follow from its parent's, and its proof of work has to be valid. Headers
+// that are already stored are ignored. It stops at the first invalid header and returns its error. The headers before it are still stored.
+func (bc *Blockchain) AddHeaders(headers []BlockHeader) error {
+	var headerErr error
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		for _, h := range headers {
+			headerErr = addHeader(tx, h); if headerErr != nil {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return headerErr
+}
+
+// addHeader validates and stores a single header within a transaction.
+func addHeader(tx *bolt.Tx, h BlockHeader) error {
+	if hasHeader(tx, h.Hash) {
+		return nil
+	}
+
+	parent, err := getHeader(tx, h.PrevBlockHash)
+	if len(h.PrevBlockHash) == 0 || err != nil {
+		return errUnknownParent
+	}
+	if isInvalid(tx, h.PrevBlockHash) {
+		return errInvalidBlock
+	}
+	err = checkHeaderContext(tx, h, parent)
+	if err != nil {
+		return err
+	}
+	if !h.ValidatePoW() {
+		return errBadPoW
+	}
+	if h.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return errTimeTooNew
+	}
+
+	_, err = storeHeader(tx, h)
+	return err
+}
+
+// HasHeader checks whether a header, or the block it belongs to, is stored in the db.
+func (bc *Blockchain) HasHeader(hash []byte) bool {
+	var found bool
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		found = hasHeader(tx, hash)
+		return nil
+	}); if err != nil {
+		panic(err)
+	}
+	return found
+}
+
+// BestHeader returns the header with the most cumulative work that we know about.
+func (bc *Blockchain) BestHeader() BlockHeader {
+	var best BlockHeader
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		best, err = getHeader(tx, bestHeaderHash(tx))
+		return err
+	}); if err != nil {
+		panic(err)
+	}
+	return best
+}
+
+// BlockLocator describes our best header chain to another node, so that it can figure out where its own chain splits from ours. It's a list
+// of hashes starting at the best header, with the first 10 one after the other, and then twice as far apart every step, ending with genesis.
+// A locator for a chain of a million blocks is still only about 30 hashes.
+func (bc *Blockchain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		h, err := getHeader(tx, bestHeaderHash(tx))
+		if err != nil {
+			return err
+		}
+
+		step := 1
+		for {
+			locator = append(locator, h.Hash)
+			if len(h.PrevBlockHash) == 0 {
+				return nil
+			}
+			if len(locator) >= 10 {
+				step *= 2
+			}
+
+			for i := 0; i < step && len(h.PrevBlockHash) > 0; i++ {
+				h, err = getHeader(tx, h.PrevBlockHash)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}); if err != nil {
+		panic(err)
+	}
+	return locator
+}
+
+// HeadersAfter finds the first hash in locator that's on our main chain, and returns the headers of up to max blocks that come after it on the
+// main chain, oldest first. If none of the hashes are on our main chain, the headers start right after genesis. A hash is on the main chain
+// if the height index has it at its header's height, so finding it takes a lookup per locator hash, and only the headers that are sent are
+// read.
+func (bc *Blockchain) HeadersAfter(locator [][]byte, max int) []BlockHeader {
+	var headers []BlockHeader
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(heightIndexBucket))
+		if hb == nil {
+			return errors.New("no height index")
+		}
+
+		fork := 0
+		for _, hash := range locator {
+			h, err := getHeader(tx, hash)
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(hb.Get(heightKey(h.Height)), hash) {
+				fork = h.Height
+				break
+			}
+		}
+
+		for height := fork + 1; len(headers) < max; height++ {
+			hash := hb.Get(heightKey(height))
+			if hash == nil {
+				break
+			}
+			h, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, h)
+		}
+		return nil
+	}); if err != nil {
+		fmt.Println("error finding headers", err)
+	}
+	return headers
+}
+
+// MissingBlocks returns the headers on our best header chain that we don't have the block for yet, oldest first. These are the blocks that
+// still need to be downloaded. Since headers are stored, this picks up where a download stopped, even after a restart.
+func (bc *Blockchain) MissingBlocks() []BlockHeader {
+	var missing []BlockHeader
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		current := bestHeaderHash(tx)
+		for b.Get(current) == nil {
+			h, err := getHeader(tx, current)
+			if err != nil {
+				return err
+			}
+			missing = append(missing, h)
+			current = h.PrevBlockHash
+		}
+		return nil
+	}); if err != nil {
+		fmt.Println("error finding missing blocks", err)
+	}
+
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing
+}
+
+// storeHeader stores a header along with the cumulative work of its chain, and makes it the best header if it has more work than the current
+// one. It returns the cumulative work. The header's parent has to be stored already.
+func storeHeader(tx *bolt.Tx, h BlockHeader) (*big.Int, error) {
+	hb, err := tx.CreateBucketIfNotExists([]byte(headersBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	parentWork := big.NewInt(0)
+	if len(h.PrevBlockHash) > 0 {
+		parentWork, err = chainWork(tx, h.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	work := new(big.Int).Add(parentWork, headerWork(h))
+
+	err = putChainWork(tx, h.Hash, work)
+	if err != nil {
+		return nil, err
+	}
+	err = hb.Put(h.Hash, h.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	bestHash := bestHeaderHash(tx)
+	if bestHash == nil || bytes.Equal(bestHash, h.Hash) {
+		return work, hb.Put([]byte("l"), h.Hash)
+	}
+	bestWork, err := chainWork(tx, bestHash)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(bestWork) > 0 {
+		err = hb.Put([]byte("l"), h.Hash)
+	}
+	return work, err
+}
+
+// bestHeaderHash returns the hash of the best header. Chains created before headers were stored don't have one yet, so the tail of the
+// blockchain is used instead.
+func bestHeaderHash(tx *bolt.Tx) []byte {
+	if hb := tx.Bucket([]byte(headersBucket)); hb != nil {
+		if best := hb.Get([]byte("l")); best != nil {
+			return append([]byte{}, best...)
+		}
+	}
+	if b := tx.Bucket([]byte(blocksBucket)); b != nil {
+		if tip := b.Get([]byte("l")); tip != nil {
+			return append([]byte{}, tip...)
+		}
+	}
+	return nil
+}
+
+// hasHeader checks whether a header, or the block it belongs to, is stored.
+func hasHeader(tx *bolt.Tx, hash []byte) bool {
+	if hb := tx.Bucket([]byte(headersBucket)); hb != nil && hb.Get(hash) != nil {
+		return true
+	}
+	return tx.Bucket([]byte(blocksBucket)).Get(hash) != nil
+}
+
+// getHeader reads a header from the headersBucket. Blocks stored before headers were kept don't have a header there, so it falls back to the
+// block itself.
+func getHeader(tx *bolt.Tx, hash []byte) (BlockHeader, error) {
+	if hb := tx.Bucket([]byte(headersBucket)); hb != nil {
+		if data := hb.Get(hash); data != nil {
+			return DeserializeHeader(data)
+		}
+	}
+
+	blk, err := getBlock(tx.Bucket([]byte(blocksBucket)), hash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	return blk.Header(), nil
+}
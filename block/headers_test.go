@@ -0,0 +1,133 @@
+package block
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// extend mines count empty blocks on top of the tail, and returns the whole main chain, genesis first.
+func (c *testChain) extend(t *testing.T, count int) []*Block {
+	for i := 0; i < count; i++ {
+		err := c.bc.AppendBlock(c.mine(t, nil, 0, nil)); if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var chain []*Block
+	itr := c.bc.RangeIterator(0, -1)
+	for itr.Next() {
+		chain = append(chain, itr.Block())
+	}
+	if err := itr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+// headerHeights returns the heights of headers, so that they're easy to compare.
+func headerHeights(headers []BlockHeader) []int {
+	var heights []int
+	for _, h := range headers {
+		heights = append(heights, h.Height)
+	}
+	return heights
+}
+
+func TestBlockLocator(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	chain := c.extend(t, 25)
+
+	// 10 hashes one after the other, then twice as far apart every step, ending with genesis
+	want := []int{25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 14, 10, 2, 0}
+	locator := c.bc.BlockLocator()
+	if len(locator) != len(want) {
+		t.Fatalf("locator has %d hashes, want %d", len(locator), len(want))
+	}
+	for i, height := range want {
+		if !bytes.Equal(locator[i], chain[height].Hash) {
+			t.Errorf("locator hash %d is %x, want the block at height %d", i, locator[i], height)
+		}
+	}
+}
+
+func TestHeadersAfter(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	chain := c.extend(t, 5)
+
+	// a node whose best chain split from ours after height 2 sends a locator that starts on its own branch
+	side := c.mineOn(t, chain[2], "side", nil, 0, nil)
+	if _, err := c.bc.AddBlock(side); err != nil {
+		t.Fatal(err)
+	}
+	sideTip := c.mineOn(t, side, "side", nil, 0, nil)
+	if _, err := c.bc.AddBlock(sideTip); err != nil {
+		t.Fatal(err)
+	}
+	locator := [][]byte{sideTip.Hash, side.Hash, chain[2].Hash, chain[1].Hash, chain[0].Hash}
+
+	tests := []struct {
+		name    string
+		locator [][]byte
+		max     int
+		want    []int
+	}{
+		{"fork on a side branch", locator, 10, []int{3, 4, 5}},
+		{"fewer than there are", locator, 2, []int{3, 4}},
+		{"locator at the tail", [][]byte{chain[5].Hash}, 10, nil},
+		{"unknown locator", [][]byte{{1, 2, 3}}, 10, []int{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		headers := c.bc.HeadersAfter(tt.locator, tt.max)
+		if got := headerHeights(headers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got headers at heights %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for _, h := range headers {
+			if !bytes.Equal(h.Hash, chain[h.Height].Hash) {
+				t.Errorf("%s: header at height %d isn't on the main chain", tt.name, h.Height)
+			}
+		}
+	}
+}
+
+func TestMissingBlocks(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	chain := c.extend(t, 1)
+	if missing := c.bc.MissingBlocks(); len(missing) != 0 {
+		t.Fatalf("%d blocks are missing before any header is ahead of the tail", len(missing))
+	}
+
+	// only the headers are stored, the way they arrive before the blocks are downloaded
+	parent := chain[1]
+	var blocks []*Block
+	for i := 0; i < 3; i++ {
+		blk := c.mineOn(t, parent, "", nil, 0, nil)
+		err := c.bc.AddHeaders([]BlockHeader{blk.Header()}); if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, blk)
+		parent = blk
+	}
+
+	if got := headerHeights(c.bc.MissingBlocks()); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("missing blocks are at heights %v, want [2 3 4]", got)
+	}
+
+	_, err := c.bc.AddBlock(blocks[0]); if err != nil {
+		t.Fatal(err)
+	}
+	missing := c.bc.MissingBlocks()
+	if got := headerHeights(missing); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("missing blocks are at heights %v after one was downloaded, want [3 4]", got)
+	}
+	if len(missing) > 0 && !bytes.Equal(missing[0].Hash, blocks[1].Hash) {
+		t.Error("the first missing block isn't the next one on the best header chain")
+	}
+}
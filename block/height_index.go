@@ -0,0 +1,195 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Blocks are stored by their hash, so without an index the only way to find the block at some height is to walk back from the tail. The height
+// index maps every height of the main chain to the hash of the block at that height. It's updated every time the tail changes, see putTip.
+
+const (
+	// heightIndexBucket maps a height, as 8 bytes big endian, to the hash of the main chain's block at that height.
+	heightIndexBucket = "heightIndexBucket"
+)
+
+// heightKey returns a height's key in the heightIndexBucket. Big endian keeps the keys sorted by height.
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// putTip makes hash the tail of the chain, and updates the height index to match the new main chain. The blocks of the new main chain are
+// indexed going back from the tail, until a height that already points at the right block, which for a block added on top of the tail is
+// right away. Heights past the new tail are removed, in case the new main chain is shorter than the old one.
+func putTip(tx *bolt.Tx, hash []byte) error {
+	b := tx.Bucket([]byte(blocksBucket))
+	err := b.Put([]byte("l"), hash)
+	if err != nil {
+		return err
+	}
+
+	hb, err := tx.CreateBucketIfNotExists([]byte(heightIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	tip, err := getBlock(b, hash)
+	if err != nil {
+		return err
+	}
+
+	var stale [][]byte
+	c := hb.Cursor()
+	for k, _ := c.Seek(heightKey(tip.Height + 1)); k != nil; k, _ = c.Next() {
+		stale = append(stale, append([]byte{}, k...))
+	}
+	for _, k := range stale {
+		err = hb.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	blk := tip
+	for {
+		key := heightKey(blk.Height)
+		if bytes.Equal(hb.Get(key), blk.Hash) {
+			return nil
+		}
+		err = hb.Put(key, blk.Hash)
+		if err != nil {
+			return err
+		}
+
+		if len(blk.PrevBlockHash) == 0 {
+			return nil
+		}
+		blk, err = getBlock(b, blk.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hasHeightIndex checks whether the height index was built. Chains created before it have to build it.
+func hasHeightIndex(tx *bolt.Tx) bool {
+	return tx.Bucket([]byte(heightIndexBucket)) != nil
+}
+
+// GetBlockHash returns the hash of the main chain's block at height.
+func (bc *Blockchain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(heightIndexBucket))
+		if hb == nil || height < 0 {
+			return fmt.Errorf("no block at height %d", height)
+		}
+
+		v := hb.Get(heightKey(height))
+		if v == nil {
+			return fmt.Errorf("no block at height %d", height)
+		}
+		hash = append([]byte{}, v...)
+		return nil
+	})
+	return hash, err
+}
+
+// GetBlockByHeight finds the main chain's block at height.
+func (bc *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	hash, err := bc.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	return bc.GetBlock(hash)
+}
+
+// BlockRangeIterator goes over the main chain's blocks from one height to another, oldest first. Every block is looked up on its own, so if the
+// main chain changes in the middle, the blocks after the change come from the new main chain.
+//
+//	itr := bc.RangeIterator(500, 600)
+//	for itr.Next() {
+//		blk := itr.Block()
+//	}
+//	if err := itr.Err(); err != nil {
+//	}
+type BlockRangeIterator struct {
+	bc     *Blockchain
+	height int // height is the height of the block Next returns next
+	end    int // end is the height of the last block, or -1 to keep going until the tail
+
+	block *Block
+	err   error
+}
+
+// RangeIterator returns an iterator over the main chain's blocks from height from up to, and including, height to. A negative to keeps going
+// until the tail of the chain.
+func (bc *Blockchain) RangeIterator(from, to int) *BlockRangeIterator {
+	if from < 0 {
+		from = 0
+	}
+	if to < 0 {
+		to = -1
+	}
+
+	return &BlockRangeIterator{
+		bc:     bc,
+		height: from,
+		end:    to,
+	}
+}
+
+// Next moves on to the next block. It returns false once it's past the last block, or when a block can't be read, see Err.
+func (i *BlockRangeIterator) Next() bool {
+	if i.err != nil || (i.end >= 0 && i.height > i.end) {
+		return false
+	}
+
+	err := i.bc.DB.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(heightIndexBucket))
+		if hb == nil {
+			return fmt.Errorf("no block at height %d", i.height)
+		}
+
+		hash := hb.Get(heightKey(i.height))
+		if hash == nil {
+			if i.end < 0 {
+				// went past the tail
+				i.block = nil
+				return nil
+			}
+			return fmt.Errorf("no block at height %d", i.height)
+		}
+
+		var err error
+		i.block, err = getBlock(tx.Bucket([]byte(blocksBucket)), hash)
+		return err
+	})
+	if err != nil {
+		i.err = err
+		i.block = nil
+		return false
+	}
+	if i.block == nil {
+		return false
+	}
+
+	i.height++
+	return true
+}
+
+// Block returns the block Next moved on to.
+func (i *BlockRangeIterator) Block() *Block {
+	return i.block
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (i *BlockRangeIterator) Err() error {
+	return i.err
+}
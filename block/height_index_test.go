@@ -0,0 +1,65 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeightIndexAfterReorg(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	// the main chain is 3 blocks past genesis, and a longer branch splits off after height 1
+	old := c.extend(t, 3)
+	branch := []*Block{old[0], old[1]}
+	for i := 0; i < 3; i++ {
+		blk := c.mineOn(t, branch[len(branch)-1], "branch", nil, 0, nil)
+		if _, err := c.bc.AddBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+		branch = append(branch, blk)
+	}
+	if !bytes.Equal(c.bc.TipHash(), branch[len(branch)-1].Hash) {
+		t.Fatal("the longer branch didn't take over")
+	}
+
+	for height, want := range branch {
+		blk, err := c.bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatalf("GetBlockByHeight(%d) returned %v", height, err)
+		}
+		if !bytes.Equal(blk.Hash, want.Hash) {
+			t.Errorf("GetBlockByHeight(%d) is %x, want %x", height, blk.Hash, want.Hash)
+		}
+	}
+	if _, err := c.bc.GetBlockByHeight(len(branch)); err == nil {
+		t.Error("GetBlockByHeight found a block past the tail")
+	}
+
+	var got []*Block
+	itr := c.bc.RangeIterator(1, -1)
+	for itr.Next() {
+		got = append(got, itr.Block())
+	}
+	if err := itr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(branch)-1 {
+		t.Fatalf("RangeIterator went over %d blocks, want %d", len(got), len(branch)-1)
+	}
+	for i, blk := range got {
+		if !bytes.Equal(blk.Hash, branch[i+1].Hash) {
+			t.Errorf("RangeIterator's block %d is %x, want %x", i, blk.Hash, branch[i+1].Hash)
+		}
+	}
+
+	// a range that ends past the tail stops with an error
+	itr = c.bc.RangeIterator(3, len(branch))
+	count := 0
+	for itr.Next() {
+		count++
+	}
+	if count != len(branch)-3 || itr.Err() == nil {
+		t.Errorf("RangeIterator past the tail went over %d blocks with error %v, want %d blocks and an error", count, itr.Err(), len(branch)-3)
+	}
+}
@@ -0,0 +1,310 @@
+package block
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMempoolSize is the most bytes of serialized transactions the mempool holds, before it starts evicting.
+	defaultMempoolSize = 5 * 1024 * 1024
+	// mempoolExpiry is how long a transaction can wait in the mempool before it's dropped.
+	mempoolExpiry = 24 * time.Hour
+)
+
+var (
+	errTxInMempool     = errors.New("transaction is already in the mempool")
+	errTxCoinbase      = errors.New("coinbase transactions can't be added to the mempool")
+	errTxDoubleSpend   = errors.New("transaction spends an output that another mempool transaction already spends")
+	errTxMissingInputs = errors.New("transaction spends an output that isn't in the UTXO set")
+	errTxWrongOwner    = errors.New("transaction spends an output locked to another key")
+	errTxBadSignature  = errors.New("transaction signature is invalid")
+	errTxNegativeFee   = errors.New("transaction outputs are worth more than its inputs")
+	errMempoolFull     = errors.New("mempool is full, and the transaction's fee rate is too low")
+)
+
+// mempoolEntry is a transaction waiting in the mempool, along with what it takes to decide which transaction to evict first.
+type mempoolEntry struct {
+	tx    Transaction
+	size  int // size is the length of the serialized transaction in bytes
+	fee   int // fee is the sum of the inputs minus the sum of the outputs
+	added time.Time
+}
+
+// lowerPriority returns true if e should be evicted before other. Lower fee rate goes first, and when fee rates are equal, the older one goes first.
+func (e *mempoolEntry) lowerPriority(other *mempoolEntry) bool {
+	// compare fee/size without dividing: e.fee/e.size < other.fee/other.size
+	left := e.fee * other.size
+	right := other.fee * e.size
+	if left != right {
+		return left < right
+	}
+	return e.added.Before(other.added)
+}
+
+// Mempool holds transactions that were validated, but aren't in a block yet. Every transaction in the mempool spends outputs from the UTXO set,
+// and no two transactions in the mempool spend the same output. It's safe to use from many goroutines.
+type Mempool struct {
+	maxSize int
+
+	mu    sync.Mutex
+	size  int
+	txs   map[string]*mempoolEntry // txs maps a hex transaction ID to its entry
+	spent map[string]string        // spent maps an outpoint (see outpointKey) to the hex ID of the mempool transaction that spends it
+}
+
+// NewMempool returns an empty mempool that holds up to maxSize bytes of transactions. A maxSize of zero means defaultMempoolSize.
+func NewMempool(maxSize int) *Mempool {
+	if maxSize <= 0 {
+		maxSize = defaultMempoolSize
+	}
+
+	return &Mempool{
+		maxSize: maxSize,
+		txs:     make(map[string]*mempoolEntry),
+		spent:   make(map[string]string),
+	}
+}
+
+// outpointKey identifies a single output by its transaction ID and index.
+func outpointKey(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+// Add validates a transaction and adds it to the mempool. The transaction must be well formed, spend outputs that are in the UTXO set and not already spent by
+// another mempool transaction, and its signatures must be valid. If the mempool is full, transactions with the lowest fee rate are evicted
+// to make room, unless the new transaction has the lowest fee rate of them all.
+func (mp *Mempool) Add(tx Transaction, u UTXOSet) error {
+	if tx.IsCoinbase() {
+		return errTxCoinbase
+	}
+	err := checkTransactionSanity(&tx); if err != nil {
+		return err
+	}
+
+	id := hex.EncodeToString(tx.ID)
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.expireLocked(time.Now())
+
+	if _, ok := mp.txs[id]; ok {
+		return errTxInMempool
+	}
+
+	inputs := 0
+	for _, vin := range tx.Vin {
+		if _, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]; ok {
+			return errTxDoubleSpend
+		}
+		out, ok := u.FindOutput(vin.Txid, vin.Vout); if !ok {
+			return errTxMissingInputs
+		}
+		if !vin.UsesKey(out.PubKeyHash) {
+			return errTxWrongOwner
+		}
+		inputs += out.Value
+	}
+
+	outputs := 0
+	for _, out := range tx.Vout {
+		outputs += out.Value
+	}
+	if outputs > inputs {
+		return errTxNegativeFee
+	}
+
+	if !u.VerifyTransaction(&tx) {
+		return errTxBadSignature
+	}
+
+	entry := &mempoolEntry{
+		tx:    tx,
+		size:  len(tx.Serialize()),
+		fee:   inputs - outputs,
+		added: time.Now(),
+	}
+
+	if !mp.makeRoomLocked(entry) {
+		return errMempoolFull
+	}
+
+	mp.txs[id] = entry
+	mp.size += entry.size
+	for _, vin := range tx.Vin {
+		mp.spent[outpointKey(vin.Txid, vin.Vout)] = id
+	}
+	return nil
+}
+
+// Get returns a transaction in the mempool by its ID.
+func (mp *Mempool) Get(txID []byte) (Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, ok := mp.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return Transaction{}, false
+	}
+	return entry.tx, true
+}
+
+// Has checks whether a transaction is in the mempool.
+func (mp *Mempool) Has(txID []byte) bool {
+	_, ok := mp.Get(txID)
+	return ok
+}
+
+// Count returns the number of transactions in the mempool.
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.txs)
+}
+
+// Select picks the transactions for a new block: up to max of them, the highest fee rate first. It also returns the sum of their fees, which
+// the block's coinbase can claim.
+func (mp *Mempool) Select(max int) ([]Transaction, int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entries := make([]*mempoolEntry, 0, len(mp.txs))
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[j].lowerPriority(entries[i])
+	})
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+
+	fees := 0
+	txs := make([]Transaction, 0, len(entries))
+	for _, entry := range entries {
+		txs = append(txs, entry.tx)
+		fees += entry.fee
+	}
+	return txs, fees
+}
+
+// RemoveBlock drops every transaction that was confirmed in a block. Transactions that spend an output that the block spent are dropped too,
+// since they can never be confirmed anymore.
+func (mp *Mempool) RemoveBlock(b *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range b.Transactions {
+		mp.removeLocked(hex.EncodeToString(tx.ID))
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if conflict, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]; ok {
+				mp.removeLocked(conflict)
+			}
+		}
+	}
+}
+
+// Revalidate drops every transaction that spends an output that isn't in the UTXO set anymore. That happens when the blocks a transaction spent
+// from are disconnected in a reorg, or when a block spends the same output. It returns how many transactions were dropped.
+func (mp *Mempool) Revalidate(u UTXOSet) int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var stale []string
+	for id, entry := range mp.txs {
+		for _, vin := range entry.tx.Vin {
+			if _, ok := u.FindOutput(vin.Txid, vin.Vout); !ok {
+				stale = append(stale, id)
+				break
+			}
+		}
+	}
+
+	for _, id := range stale {
+		mp.removeLocked(id)
+	}
+	return len(stale)
+}
+
+// Flush drops every transaction in the mempool.
+func (mp *Mempool) Flush() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.size = 0
+	mp.txs = make(map[string]*mempoolEntry)
+	mp.spent = make(map[string]string)
+}
+
+// removeLocked drops a single transaction, and frees up the outputs it spent. mp.mu must be held.
+func (mp *Mempool) removeLocked(id string) {
+	entry, ok := mp.txs[id]
+	if !ok {
+		return
+	}
+
+	for _, vin := range entry.tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if mp.spent[key] == id {
+			delete(mp.spent, key)
+		}
+	}
+	mp.size -= entry.size
+	delete(mp.txs, id)
+}
+
+// expireLocked drops every transaction that has been waiting longer than mempoolExpiry. mp.mu must be held.
+func (mp *Mempool) expireLocked(now time.Time) {
+	for id, entry := range mp.txs {
+		if now.Sub(entry.added) > mempoolExpiry {
+			mp.removeLocked(id)
+		}
+	}
+}
+
+// makeRoomLocked evicts the lowest priority transactions until entry fits. If entry would have to evict a transaction with a higher priority
+// than itself, nothing is evicted and false is returned. mp.mu must be held.
+func (mp *Mempool) makeRoomLocked(entry *mempoolEntry) bool {
+	if entry.size > mp.maxSize {
+		return false
+	}
+	if mp.size+entry.size <= mp.maxSize {
+		return true
+	}
+
+	entries := make([]*mempoolEntry, 0, len(mp.txs))
+	for _, e := range mp.txs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lowerPriority(entries[j])
+	})
+
+	// first find out how many transactions would need to go, and only evict them if they are all lower priority than entry
+	freed := 0
+	evict := 0
+	for _, e := range entries {
+		if mp.size-freed+entry.size <= mp.maxSize {
+			break
+		}
+		if !e.lowerPriority(entry) {
+			return false
+		}
+		freed += e.size
+		evict++
+	}
+
+	for _, e := range entries[:evict] {
+		mp.removeLocked(hex.EncodeToString(e.tx.ID))
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// coinbaseSpends returns a transaction for each block of chain after genesis, that spends the block's coinbase back to the owner, and pays
+// fees[i] in fees.
+func (c *testChain) coinbaseSpends(t *testing.T, chain []*Block, fees ...int) []*Transaction {
+	var txs []*Transaction
+	for i, fee := range fees {
+		cb := chain[i+1].Transactions[0]
+		in := TXInput{Txid: cb.ID, Vout: 0, PubKey: c.owner.PublicKey}
+		txs = append(txs, c.spend(t, c.owner.PrivateKey, []TXInput{in}, NewTXOutput(cb.Vout[0].Value-fee, string(c.owner.GetAddress()))))
+	}
+	return txs
+}
+
+func TestMempoolEviction(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	chain := c.extend(t, 4)
+	txs := c.coinbaseSpends(t, chain, 2, 1, 3, 0)
+	u := UTXOSet{Blockchain: c.bc}
+
+	// room for two of the transactions, but not for three
+	size := len(txs[0].Serialize())
+	mp := NewMempool(2*size + size/2)
+
+	for _, tx := range txs[:2] {
+		err := mp.Add(*tx, u); if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the transaction with the lowest fee rate makes room for one with a higher fee rate
+	err := mp.Add(*txs[2], u); if err != nil {
+		t.Fatalf("Add returned %v for a transaction with a higher fee rate than the ones in a full mempool", err)
+	}
+	if mp.Has(txs[1].ID) || !mp.Has(txs[0].ID) || !mp.Has(txs[2].ID) {
+		t.Error("the transaction with the lowest fee rate wasn't the one evicted")
+	}
+
+	// but a transaction with a lower fee rate than every one in the mempool doesn't get in
+	if err := mp.Add(*txs[3], u); err != errMempoolFull {
+		t.Errorf("Add returned %v, want %v", err, errMempoolFull)
+	}
+	if mp.Count() != 2 {
+		t.Errorf("mempool has %d transactions, want 2", mp.Count())
+	}
+
+	selected, fees := mp.Select(10)
+	if len(selected) != 2 || fees != 5 {
+		t.Errorf("Select returned %d transactions with %d in fees, want 2 and 5", len(selected), fees)
+	}
+
+	// the outputs an evicted transaction spent are free again
+	mp.Flush()
+	if err := mp.Add(*txs[1], u); err != nil {
+		t.Errorf("Add returned %v for an evicted transaction once there's room", err)
+	}
+}
+
+func TestMempoolExpiry(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	chain := c.extend(t, 2)
+	txs := c.coinbaseSpends(t, chain, 1, 1)
+	u := UTXOSet{Blockchain: c.bc}
+	mp := NewMempool(0)
+
+	err := mp.Add(*txs[0], u); if err != nil {
+		t.Fatal(err)
+	}
+	mp.txs[hex.EncodeToString(txs[0].ID)].added = time.Now().Add(-mempoolExpiry + time.Minute)
+	err = mp.Add(*txs[1], u); if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.Has(txs[0].ID) {
+		t.Error("a transaction was dropped before it expired")
+	}
+
+	mp.txs[hex.EncodeToString(txs[0].ID)].added = time.Now().Add(-mempoolExpiry - time.Minute)
+	mp.mu.Lock()
+	mp.expireLocked(time.Now())
+	mp.mu.Unlock()
+	if mp.Has(txs[0].ID) || !mp.Has(txs[1].ID) {
+		t.Error("only the transaction that waited past mempoolExpiry should be dropped")
+	}
+
+	// the outputs it spent can be spent again
+	if err := mp.Add(*txs[0], u); err != nil {
+		t.Errorf("Add returned %v for an expired transaction", err)
+	}
+}
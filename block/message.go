@@ -0,0 +1,105 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message sent between nodes is wrapped in an envelope. The envelope starts with a header, and the payload comes right after it:
+//
+//	magic    4 bytes  - identifies the network. Messages from a different network are rejected.
+//	command 12 bytes  - the name of the message, i.e "version", padded with zeros.
+//	length   4 bytes  - the length of the payload in bytes.
+//	checksum 4 bytes  - the first 4 bytes of a double sha256 hash of the payload.
+//
+// Since the length of every payload is known up front, many messages can be sent one after the other over a single connection.
+// The checksum lets us reject a payload that was corrupted on the way.
+const (
+	networkMagic        = uint32(0xac01c0de)
+	commandLength       = 12
+	messageHeaderLength = 4 + commandLength + 4 + 4
+	maxPayloadLength    = 32 * 1024 * 1024
+)
+
+var (
+	errWrongNetwork    = errors.New("message is from a different network")
+	errBadChecksum     = errors.New("message checksum does not match its payload")
+	errPayloadTooLarge = errors.New("message payload is too large")
+)
+
+// writeMessage wraps a payload in an envelope and writes it to w.
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("command %q is longer than %d bytes", command, commandLength)
+	}
+	if len(payload) > maxPayloadLength {
+		return errPayloadTooLarge
+	}
+
+	var header [messageHeaderLength]byte
+	binary.BigEndian.PutUint32(header[0:4], networkMagic)
+	copy(header[4:4+commandLength], commandToBytes(command))
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(payload)))
+	copy(header[20:24], checksum(payload))
+
+	_, err := w.Write(append(header[:], payload...))
+	return err
+}
+
+// readMessage reads a single message from r. It returns io.EOF if r was closed cleanly before a new message started.
+// A message that is cut off, from another network, or whose payload doesn't match its checksum, returns an error.
+func readMessage(r io.Reader) (string, []byte, error) {
+	var header [messageHeaderLength]byte
+
+	_, err := io.ReadFull(r, header[:]); if err != nil {
+		return "", nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != networkMagic {
+		return "", nil, errWrongNetwork
+	}
+
+	command := bytesToCommand(header[4 : 4+commandLength])
+	length := binary.BigEndian.Uint32(header[16:20])
+	if length > maxPayloadLength {
+		return "", nil, errPayloadTooLarge
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload); if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+
+	if !bytes.Equal(checksum(payload), header[20:24]) {
+		return "", nil, errBadChecksum
+	}
+
+	return command, payload, nil
+}
+
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range command {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+	return fmt.Sprintf("%s", command)
+}
@@ -0,0 +1,97 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// encodeMessage returns a message the way writeMessage writes it, so that it can be tampered with.
+func encodeMessage(t *testing.T, command string, payload []byte) []byte {
+	var buff bytes.Buffer
+	err := writeMessage(&buff, command, payload); if err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		command string
+		payload []byte
+	}{
+		{"version", []byte("payload")},
+		{"getheaders", nil},
+		{"commandof12b", bytes.Repeat([]byte{0xff}, 4096)},
+	}
+
+	// every message goes over the same stream, one after the other
+	var stream bytes.Buffer
+	for _, tt := range tests {
+		err := writeMessage(&stream, tt.command, tt.payload); if err != nil {
+			t.Fatalf("writeMessage(%q) returned %v", tt.command, err)
+		}
+	}
+
+	for _, tt := range tests {
+		command, payload, err := readMessage(&stream)
+		if err != nil {
+			t.Fatalf("readMessage returned %v for %q", err, tt.command)
+		}
+		if command != tt.command || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("read %q with a %d byte payload, want %q with a %d byte payload", command, len(payload), tt.command, len(tt.payload))
+		}
+	}
+	if _, _, err := readMessage(&stream); err != io.EOF {
+		t.Errorf("readMessage returned %v at the end of the stream, want %v", err, io.EOF)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	valid := encodeMessage(t, "block", []byte("some block"))
+
+	tamper := func(fn func(msg []byte) []byte) []byte {
+		return fn(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{"wrong magic", tamper(func(msg []byte) []byte {
+			binary.BigEndian.PutUint32(msg[0:4], networkMagic+1)
+			return msg
+		}), errWrongNetwork},
+		{"bad checksum", tamper(func(msg []byte) []byte {
+			msg[len(msg)-1] ^= 0xff
+			return msg
+		}), errBadChecksum},
+		{"oversized length", tamper(func(msg []byte) []byte {
+			binary.BigEndian.PutUint32(msg[16:20], maxPayloadLength+1)
+			return msg
+		}), errPayloadTooLarge},
+		{"truncated payload", valid[:len(valid)-3], io.ErrUnexpectedEOF},
+		{"payload missing", valid[:messageHeaderLength], io.ErrUnexpectedEOF},
+		{"truncated header", valid[:messageHeaderLength-1], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, _, err := readMessage(bytes.NewReader(tt.msg)); err != tt.want {
+			t.Errorf("%s: readMessage returned %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWriteMessageErrors(t *testing.T) {
+	var buff bytes.Buffer
+	if err := writeMessage(&buff, "commandlonger", nil); err == nil {
+		t.Error("writeMessage accepted a command longer than commandLength")
+	}
+	if err := writeMessage(&buff, "block", make([]byte, maxPayloadLength+1)); err != errPayloadTooLarge {
+		t.Errorf("writeMessage returned %v for a payload that's too large, want %v", err, errPayloadTooLarge)
+	}
+	if buff.Len() != 0 {
+		t.Error("writeMessage wrote a message it rejected")
+	}
+}
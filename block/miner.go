@@ -0,0 +1,185 @@
+package block
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hashrateReportInterval is how often the miner reports its hashrate.
+const hashrateReportInterval = 5 * time.Second
+
+// Miner mines blocks on every core. The nonce space is split into one range per worker, and every worker hashes its own range. Once a worker
+// finds a hash below the target, the others stop. If every nonce was tried without luck, the header is changed and the nonces are tried again:
+// the timestamp is moved forward if the clock moved on, otherwise the extra-nonce in the coinbase transaction is increased, which changes the
+// merkle root.
+type Miner struct {
+	workers    int
+	onHashrate func(hashesPerSecond float64) // onHashrate is called every hashrateReportInterval while mining. It can be nil.
+}
+
+// NewMiner returns a miner with workers goroutines. Zero workers means one per core, runtime.GOMAXPROCS. onHashrate is called with the number
+// of hashes per second every hashrateReportInterval while a block is being mined, it can be nil.
+func NewMiner(workers int, onHashrate func(hashesPerSecond float64)) *Miner {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Miner{
+		workers:    workers,
+		onHashrate: onHashrate,
+	}
+}
+
+// Mine searches for a nonce that makes the block's hash smaller than its target, and sets the block's nonce and hash. Its timestamp, and the
+// coinbase transaction's extra-nonce, may be changed along the way. It returns ctx's error if ctx is cancelled before a hash is found, i.e when
+// another node found a block first and there's no point to keep mining this one.
+func (m *Miner) Mine(ctx context.Context, b *Block) error {
+	var hashes uint64
+
+	if m.onHashrate != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go m.reportHashrate(&hashes, stop)
+	}
+
+	target := CompactToBig(b.Bits)
+	var extraNonce uint64
+
+	for {
+		nonce, found := m.searchNonces(ctx, b.BlockHeader.Bytes(), target, &hashes)
+		if found {
+			b.Nonce = nonce
+			b.Hash = b.ComputeHash()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rollHeader(b, &extraNonce)
+	}
+}
+
+// searchNonces splits every nonce between the workers, and waits until one of them finds a hash below target, or they all run out of nonces.
+func (m *Miner) searchNonces(ctx context.Context, header []byte, target *big.Int, hashes *uint64) (uint32, bool) {
+	roundCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan uint32, m.workers)
+	chunk := (uint64(math.MaxUint32) + 1) / uint64(m.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		start := uint64(i) * chunk
+		end := start + chunk - 1
+		if i == m.workers-1 {
+			end = math.MaxUint32
+		}
+
+		wg.Add(1)
+		go func(start, end uint32) {
+			defer wg.Done()
+			nonce, ok := searchRange(roundCtx, header, target, start, end, hashes)
+			if ok {
+				results <- nonce
+				cancel()
+			}
+		}(uint32(start), uint32(end))
+	}
+	wg.Wait()
+
+	select {
+	case nonce := <-results:
+		return nonce, true
+	default:
+		return 0, false
+	}
+}
+
+// searchRange hashes the header with every nonce from start to end, until the hash is below target. ctx is checked every checkContextEvery
+// nonces, which is also how often the hash count is updated.
+func searchRange(ctx context.Context, header []byte, target *big.Int, start, end uint32, hashes *uint64) (uint32, bool) {
+	var hashInt big.Int
+
+	// every worker gets its own copy, since the nonce is written into it
+	data := append([]byte{}, header...)
+
+	for nonce := start; ; nonce++ {
+		if (nonce-start)%checkContextEvery == 0 {
+			if nonce != start {
+				atomic.AddUint64(hashes, checkContextEvery)
+			}
+			select {
+			case <-ctx.Done():
+				return 0, false
+			default:
+			}
+		}
+
+		binary.BigEndian.PutUint32(data[headerNonceOffset:], nonce)
+		hash := sha256.Sum256(data)
+		hashInt.SetBytes(hash[:])
+		if hashInt.Cmp(target) == -1 {
+			return nonce, true
+		}
+
+		if nonce == end {
+			return 0, false
+		}
+	}
+}
+
+// rollHeader changes the block's header once every nonce was tried. If the clock moved past the block's timestamp, the timestamp is moved
+// forward. Otherwise the extra-nonce is increased and written into the coinbase transaction, and the merkle root is worked out again.
+func rollHeader(b *Block, extraNonce *uint64) {
+	if now := time.Now().Unix(); now > b.Timestamp {
+		b.Timestamp = now
+		return
+	}
+
+	// a coinbase without room for the extra-nonce can't be changed, so the timestamp is moved ahead of the clock instead
+	if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinbase() || len(b.Transactions[0].Vin[0].PubKey) < coinbaseHeightLen+coinbaseExtraNonceLen {
+		b.Timestamp++
+		return
+	}
+
+	*extraNonce++
+	setExtraNonce(b.Transactions[0], *extraNonce)
+	b.MerkleRoot = b.HashTransactions()
+}
+
+// setExtraNonce writes extraNonce into a coinbase transaction's data, right after the height, and works out its ID again.
+func setExtraNonce(coinbase *Transaction, extraNonce uint64) {
+	data := append([]byte{}, coinbase.Vin[0].PubKey...)
+	binary.BigEndian.PutUint64(data[coinbaseHeightLen:], extraNonce)
+
+	coinbase.Vin[0].PubKey = data
+	coinbase.ID = coinbase.Hash()
+}
+
+// reportHashrate calls onHashrate every hashrateReportInterval, until stop is closed.
+func (m *Miner) reportHashrate(hashes *uint64, stop chan struct{}) {
+	ticker := time.NewTicker(hashrateReportInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	var lastHashes uint64
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			total := atomic.LoadUint64(hashes)
+			m.onHashrate(float64(total-lastHashes) / now.Sub(last).Seconds())
+			last = now
+			lastHashes = total
+		}
+	}
+}
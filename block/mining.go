@@ -0,0 +1,147 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// maxBlockTransactions is the most mempool transactions put into a single mined block.
+	maxBlockTransactions = 500
+	// miningPollInterval is how often the mining loop checks the mempool, in case it missed a signal.
+	miningPollInterval = 5 * time.Second
+)
+
+// miningLoop runs on nodes started with a miner address. Whenever there are transactions waiting in the mempool, it mines a block out of them,
+// adds it to the chain, and announces it to every peer.
+func (n *Node) miningLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(miningPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.mineSignal:
+		case <-ticker.C:
+		}
+
+		for n.mempool.Count() > 0 {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			// wait for the next signal before trying again, instead of failing over and over
+			err := n.mineBlock(); if err != nil {
+				fmt.Println("error mining block", err)
+				break
+			}
+		}
+	}
+}
+
+// signalMiner wakes up the mining loop. It never blocks.
+func (n *Node) signalMiner() {
+	select {
+	case n.mineSignal <- struct{}{}:
+	default:
+	}
+}
+
+// cancelMining stops the block that's being mined right now, if there is one. It's called when another node's block becomes our new tip,
+// since the block we're mining builds on a block that isn't the tip anymore. The mining loop starts over on top of the new tip.
+func (n *Node) cancelMining() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.miningCancel != nil {
+		n.miningCancel()
+	}
+}
+
+// mineBlock mines a single block out of the mempool transactions with the highest fee rates, plus a coinbase transaction that pays the subsidy
+// and the fees to the miner address. The block is checked against the UTXO set before it's mined, and again when it's added to the chain,
+// since the chain can change while it's being mined. Mining being cancelled, or another block taking the tip first, isn't an error, the
+// mining loop just starts over on the new tip.
+func (n *Node) mineBlock() error {
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+
+	n.mu.Lock()
+	n.miningCancel = cancel
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		n.miningCancel = nil
+		n.mu.Unlock()
+	}()
+
+	newBlock, err := n.blockTemplate(); if err != nil {
+		return err
+	}
+	fmt.Printf("Mining block containing %d transactions\n", len(newBlock.Transactions))
+
+	err = n.miner.Mine(ctx, newBlock); if err != nil {
+		fmt.Println("Mining cancelled, starting over on the new tip")
+		return nil
+	}
+
+	n.chainMu.Lock()
+	err = n.bc.AppendBlock(newBlock)
+	if err == nil {
+		n.mempool.RemoveBlock(newBlock)
+	}
+	n.chainMu.Unlock()
+
+	if err == errStaleTip {
+		fmt.Println("Another block took the tip first, starting over on the new tip")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error adding mined block: %w", err)
+	}
+
+	fmt.Printf("Mined a new block %x\n", newBlock.Hash)
+	n.peers.Broadcast("inv", n.invPayload("block", [][]byte{newBlock.Hash}), nil)
+	return nil
+}
+
+// blockTemplate picks the mempool transactions for a new block on top of the tail, and checks them against the UTXO set. The mempool and the
+// tail are read under n.chainMu, so that they agree with each other. If the transactions aren't valid, the mempool transactions that don't
+// spend from the UTXO set anymore are dropped, and an error is returned.
+func (n *Node) blockTemplate() (*Block, error) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	var txs []*Transaction
+	selected, fees := n.mempool.Select(maxBlockTransactions)
+	for _, tx := range selected {
+		tx := tx
+		txs = append(txs, &tx)
+	}
+
+	lastHash, lastHeight := n.bc.lastBlock()
+
+	// the coinbase commits to the height, so the tag doesn't have to make it unique
+	cbTx := NewCoinbaseTX(n.miningAddress, fmt.Sprintf("mined by %s", n.address), lastHeight+1, fees)
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	newBlock, err := n.bc.blockTemplate(txs, lastHash, lastHeight); if err != nil {
+		return nil, fmt.Errorf("error creating the block template: %w", err)
+	}
+
+	err = n.bc.DB.View(func(tx *bolt.Tx) error {
+		return checkBlockTransactions(tx, newBlock)
+	}); if err != nil {
+		dropped := n.mempool.Revalidate(UTXOSet{Blockchain: n.bc})
+		return nil, fmt.Errorf("block template is invalid, dropped %d mempool transactions: %w", dropped, err)
+	}
+	return newBlock, nil
+}
@@ -0,0 +1,215 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptRetryDelay is how long to wait before accepting again, after the listener returned a temporary error.
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Node is a single running acoin node. It listens for inbound connections, keeps outbound connections to its peers, and keeps its blockchain in
+// sync with theirs. Every piece of state belongs to the node, so many nodes can run in one process, and be started and stopped over and over.
+type Node struct {
+	cfg           Config
+	address       string // address is the address the node listens on, i.e localhost:3000
+	miningAddress string
+
+	bc       *Blockchain
+	peers    *PeerManager
+	listener net.Listener
+
+	// chainMu serializes everything that changes the chain or the UTXO set. Every peer's messages are handled on that peer's own goroutine,
+	// so two blocks can arrive at the same time, and they have to be added one after the other.
+	chainMu sync.Mutex
+
+	mempool *Mempool
+	orphans *OrphanPool
+
+	mu           sync.Mutex // mu guards downloader and miningCancel
+	downloader   *blockDownloader
+	miningCancel context.CancelFunc // miningCancel cancels the block being mined right now
+
+	miner      *Miner
+	mineSignal chan struct{}   // mineSignal wakes up the mining loop when a transaction is added to the mempool
+	ctx        context.Context // ctx is cancelled when the node stops
+	cancel     context.CancelFunc
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	quit     chan struct{} // quit is closed as soon as the node starts stopping
+	done     chan struct{} // done is closed once the node has fully stopped
+}
+
+// NewNode returns a node for cfg. Nothing is opened until Start is called.
+func NewNode(cfg Config) *Node {
+	return &Node{
+		cfg:           cfg,
+		address:       fmt.Sprintf("localhost:%s", cfg.NodeID),
+		miningAddress: cfg.MinerAddress,
+		mempool:       NewMempool(cfg.MempoolSize),
+		orphans:       NewOrphanPool(maxOrphanBlocks),
+		downloader:    newBlockDownloader(),
+		miner:         NewMiner(cfg.MinerThreads, cfg.OnHashrate),
+		mineSignal:    make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start opens the node's blockchain, starts listening, and starts connecting to peers. It doesn't block, the node keeps running in the background
+// until ctx is cancelled or Stop is called. Done can be used to wait for the node to finish stopping.
+func (n *Node) Start(ctx context.Context) error {
+	bc, err := OpenBlockchain(n.cfg.DataDir); if err != nil {
+		return err
+	}
+
+	store, err := NewPeerStore(bc.DB); if err != nil {
+		bc.DB.Close()
+		return err
+	}
+
+	ln, err := net.Listen(protocol, n.address); if err != nil {
+		bc.DB.Close()
+		return err
+	}
+
+	n.bc = bc
+	n.listener = ln
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.peers = NewPeerManager(n.cfg.MaxOutbound, store, n.handleMessage, n.onOutbound)
+
+	for _, seed := range n.cfg.Seeds {
+		n.addAddress(seed)
+	}
+	n.peers.Start()
+
+	n.wg.Add(2)
+	go n.acceptLoop()
+	go n.syncLoop()
+
+	if n.miningAddress != "" {
+		n.wg.Add(1)
+		go n.miningLoop()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-n.done:
+		}
+	}()
+
+	return nil
+}
+
+// Stop closes the listener, disconnects every peer and waits for their goroutines to finish, flushes the mempool and orphan pool, and closes the db.
+// It's safe to call more than once, and from many goroutines. Every call returns once the node has fully stopped.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		if n.cancel != nil {
+			n.cancel()
+		}
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		if n.peers != nil {
+			n.peers.Stop()
+		}
+		n.wg.Wait()
+
+		n.mempool.Flush()
+		n.orphans.Flush()
+
+		n.mu.Lock()
+		n.downloader.reset()
+		n.mu.Unlock()
+
+		if n.bc != nil {
+			err := n.bc.DB.Close(); if err != nil {
+				fmt.Println("error closing db", err)
+			}
+		}
+		close(n.done)
+	})
+	<-n.done
+}
+
+// Done returns a channel that's closed once the node has stopped.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Address returns the address the node listens on.
+func (n *Node) Address() string {
+	return n.address
+}
+
+// Blockchain returns the node's blockchain. It's nil until the node is started.
+func (n *Node) Blockchain() *Blockchain {
+	return n.bc
+}
+
+// Mempool returns the node's mempool.
+func (n *Node) Mempool() *Mempool {
+	return n.mempool
+}
+
+// SubmitTransaction adds a transaction created on this node to the mempool, and announces it to every peer.
+func (n *Node) SubmitTransaction(tx *Transaction) error {
+	n.chainMu.Lock()
+	err := n.mempool.Add(*tx, UTXOSet{Blockchain: n.bc})
+	n.chainMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	n.peers.Broadcast("inv", n.invPayload("tx", [][]byte{tx.ID}), nil)
+	n.signalMiner()
+	return nil
+}
+
+// SendTransaction sends a transaction to the node that listens on addr, the way a peer would, and hangs up. It's meant for programs that
+// aren't nodes themselves, like the CLI. The node checks the transaction and adds it to its mempool, but doesn't answer, so a nil error only
+// means the transaction was delivered, not that it was accepted.
+func SendTransaction(addr string, tx *Transaction) error {
+	conn, err := net.DialTimeout(protocol, addr, peerDialTimeout); if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := GobEncode(TxMsg{Transaction: tx.Serialize()})
+	return writeMessage(conn, "tx", payload)
+}
+
+// acceptLoop accepts inbound connections until the listener is closed.
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept(); if err != nil {
+			// the listener was closed by Stop
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			fmt.Println("error accepting connection", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		n.peers.AddInbound(conn)
+	}
+}
+
+// onOutbound introduces us to a peer we just connected to, and asks it for the peers it knows about.
+func (n *Node) onOutbound(p *Peer) {
+	n.sendVersion(p)
+	n.sendGetAddr(p)
+}
@@ -0,0 +1,172 @@
+package block
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// maxOrphanBlocks is the most blocks the orphan pool holds. Once it's full, the oldest orphan is evicted to make room.
+	maxOrphanBlocks = 100
+	// orphanExpiry is how long a block can wait for its parent, before it's dropped.
+	orphanExpiry = 20 * time.Minute
+)
+
+// orphanBlock is a block waiting in the orphan pool for its parent to arrive.
+type orphanBlock struct {
+	block *Block
+	added time.Time
+}
+
+// OrphanPool holds blocks that arrived before their parent. Blocks don't always arrive in order, i.e when two peers send us blocks at the same
+// time, or when a peer mined a few blocks on a branch we haven't seen. Instead of dropping those blocks, they wait in the orphan pool, keyed
+// by the parent they're missing, until the parent is added to the chain. It's safe to use from many goroutines.
+type OrphanPool struct {
+	maxOrphans int
+
+	mu       sync.Mutex
+	orphans  map[string]*orphanBlock   // orphans maps a hex block hash to its orphan
+	byParent map[string][]*orphanBlock // byParent maps the hex hash of a missing parent to every orphan waiting on it
+}
+
+// NewOrphanPool returns an empty orphan pool that holds up to maxOrphans blocks. A maxOrphans of zero means maxOrphanBlocks.
+func NewOrphanPool(maxOrphans int) *OrphanPool {
+	if maxOrphans <= 0 {
+		maxOrphans = maxOrphanBlocks
+	}
+
+	return &OrphanPool{
+		maxOrphans: maxOrphans,
+		orphans:    make(map[string]*orphanBlock),
+		byParent:   make(map[string][]*orphanBlock),
+	}
+}
+
+// Add puts a block in the pool, evicting the oldest orphan if the pool is full. It returns false if the block is already in the pool.
+func (op *OrphanPool) Add(b *Block) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	now := time.Now()
+	op.expireLocked(now)
+
+	hash := hex.EncodeToString(b.Hash)
+	if _, ok := op.orphans[hash]; ok {
+		return false
+	}
+
+	for len(op.orphans) >= op.maxOrphans {
+		op.removeLocked(op.oldestLocked())
+	}
+
+	orphan := &orphanBlock{block: b, added: now}
+	parent := hex.EncodeToString(b.PrevBlockHash)
+	op.orphans[hash] = orphan
+	op.byParent[parent] = append(op.byParent[parent], orphan)
+	return true
+}
+
+// Has checks whether a block is waiting in the pool.
+func (op *OrphanPool) Has(hash []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	_, ok := op.orphans[hex.EncodeToString(hash)]
+	return ok
+}
+
+// Count returns the number of blocks in the pool.
+func (op *OrphanPool) Count() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return len(op.orphans)
+}
+
+// MissingAncestor follows a block's parents through the pool, and returns the hash of the first ancestor that isn't in the pool. That's the
+// block that has to be requested, before the block can be added to the chain.
+func (op *OrphanPool) MissingAncestor(b *Block) []byte {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	missing := b.PrevBlockHash
+	for {
+		orphan, ok := op.orphans[hex.EncodeToString(missing)]
+		if !ok {
+			return missing
+		}
+		missing = orphan.block.PrevBlockHash
+	}
+}
+
+// TakeChildren removes every orphan waiting on parentHash from the pool, and returns them. Call it once the parent was added to the chain.
+func (op *OrphanPool) TakeChildren(parentHash []byte) []*Block {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.expireLocked(time.Now())
+
+	var children []*Block
+	for _, orphan := range op.byParent[hex.EncodeToString(parentHash)] {
+		children = append(children, orphan.block)
+	}
+	for _, child := range children {
+		op.removeLocked(hex.EncodeToString(child.Hash))
+	}
+	return children
+}
+
+// Flush removes every block from the pool.
+func (op *OrphanPool) Flush() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.orphans = make(map[string]*orphanBlock)
+	op.byParent = make(map[string][]*orphanBlock)
+}
+
+// removeLocked removes a single orphan from the pool. op.mu must be held.
+func (op *OrphanPool) removeLocked(hash string) {
+	orphan, ok := op.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(op.orphans, hash)
+
+	parent := hex.EncodeToString(orphan.block.PrevBlockHash)
+	siblings := op.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byParent, parent)
+	} else {
+		op.byParent[parent] = siblings
+	}
+}
+
+// expireLocked drops every orphan that has been waiting longer than orphanExpiry. op.mu must be held.
+func (op *OrphanPool) expireLocked(now time.Time) {
+	for hash, orphan := range op.orphans {
+		if now.Sub(orphan.added) > orphanExpiry {
+			op.removeLocked(hash)
+		}
+	}
+}
+
+// oldestLocked returns the hash of the orphan that has been in the pool the longest. op.mu must be held.
+func (op *OrphanPool) oldestLocked() string {
+	var (
+		oldest string
+		added  time.Time
+	)
+	for hash, orphan := range op.orphans {
+		if oldest == "" || orphan.added.Before(added) {
+			oldest = hash
+			added = orphan.added
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,453 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	peerSendQueueSize    = 256
+	defaultOutboundPeers = 8
+	peerDialTimeout      = 5 * time.Second
+	minReconnectBackoff  = 1 * time.Second
+	maxReconnectBackoff  = 5 * time.Minute
+	connectInterval      = 1 * time.Second
+)
+
+// messageHandler is called for every message read off of a peer's connection.
+type messageHandler func(p *Peer, command string, payload []byte)
+
+// outMessage is a message waiting in a peer's send queue.
+type outMessage struct {
+	command string
+	payload []byte
+}
+
+// Peer represents a single long lived connection to another node. Every peer has its own read and write goroutine. Messages are never written
+// directly to the connection, instead they are queued with Send, and the write goroutine writes them one after the other.
+type Peer struct {
+	conn    net.Conn
+	addr    string // addr is the address the peer listens on. For inbound peers it's only known once they send their version.
+	Inbound bool   // Inbound is true if the peer connected to us, and false if we connected to the peer.
+	height  int    // height is the height of the peer's best block, as far as we know.
+
+	lastAddr time.Time // lastAddr is when the peer last sent us an addr message that we didn't ignore.
+
+	mu   sync.Mutex
+	send chan outMessage
+	quit chan struct{}
+	once sync.Once
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		conn:    conn,
+		addr:    addr,
+		Inbound: inbound,
+		send:    make(chan outMessage, peerSendQueueSize),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Addr returns the address the peer listens on. Until an inbound peer sends its version, this is the address it connected from.
+func (p *Peer) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+// setAddr sets the address the peer listens on. Called once an inbound peer tells us its address in its version message.
+func (p *Peer) setAddr(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addr = addr
+}
+
+// Height returns the height of the peer's best block, as far as we know. It's what the peer said in its version, or the height of the latest
+// header or block it sent us, whichever is higher.
+func (p *Peer) Height() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.height
+}
+
+// setHeight records that the peer has a block at height. The height never goes down.
+func (p *Peer) setHeight(height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if height > p.height {
+		p.height = height
+	}
+}
+
+// allowAddr checks whether the peer waited at least minAddrInterval since its last addr message. If it did, now is recorded as the time of
+// its last one.
+func (p *Peer) allowAddr(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.lastAddr.IsZero() && now.Sub(p.lastAddr) < minAddrInterval {
+		return false
+	}
+	p.lastAddr = now
+	return true
+}
+
+// Send queues a message to be written to the peer. If the peer is too slow to keep up with its queue, it's disconnected.
+func (p *Peer) Send(command string, payload []byte) {
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+
+	select {
+	case p.send <- outMessage{command: command, payload: payload}:
+	case <-p.quit:
+	default:
+		fmt.Printf("send queue for %s is full, disconnecting\n", p.Addr())
+		p.Close()
+	}
+}
+
+// Close closes the connection to the peer. It's safe to call more than once.
+func (p *Peer) Close() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// readLoop reads messages off of the connection and passes them to handler, until the connection is closed or a bad message is read.
+func (p *Peer) readLoop(handler messageHandler) {
+	defer p.Close()
+
+	for {
+		command, payload, err := readMessage(p.conn); if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				if err != io.EOF {
+					fmt.Println("error reading message from", p.Addr(), err)
+				}
+			}
+			return
+		}
+		fmt.Printf("Recieved %s command\n", command)
+
+		handler(p, command, payload)
+	}
+}
+
+// writeLoop writes every queued message to the connection, until the peer is closed.
+func (p *Peer) writeLoop() {
+	defer p.Close()
+
+	for {
+		select {
+		case msg := <-p.send:
+			err := writeMessage(p.conn, msg.command, msg.payload); if err != nil {
+				fmt.Println("error sending data to", p.Addr(), err)
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// outboundAddr keeps track of an address we want an outbound connection to, and when we're allowed to try it again.
+type outboundAddr struct {
+	failures    int
+	nextAttempt time.Time
+	peer        *Peer
+}
+
+// PeerManager keeps track of every connected peer. It accepts inbound connections, and dials out to known addresses until it has
+// targetOutbound outbound peers. When an outbound peer can't be reached or disconnects, the address is retried with an exponential backoff.
+type PeerManager struct {
+	targetOutbound int
+	store          *PeerStore // store is where known peers are persisted. It can be nil.
+	handler        messageHandler
+	onOutbound     func(p *Peer) // onOutbound is called once an outbound connection is made, before any message is read.
+
+	mu    sync.Mutex
+	peers map[*Peer]struct{}
+	addrs map[string]*outboundAddr
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPeerManager returns a PeerManager that targets targetOutbound outbound peers. Every message read from any peer is passed to handler.
+// Connection attempts are recorded in store, and every address it knows about is added as an outbound candidate.
+func NewPeerManager(targetOutbound int, store *PeerStore, handler messageHandler, onOutbound func(p *Peer)) *PeerManager {
+	if targetOutbound <= 0 {
+		targetOutbound = defaultOutboundPeers
+	}
+
+	pm := &PeerManager{
+		targetOutbound: targetOutbound,
+		store:          store,
+		handler:        handler,
+		onOutbound:     onOutbound,
+		peers:          make(map[*Peer]struct{}),
+		addrs:          make(map[string]*outboundAddr),
+		quit:           make(chan struct{}),
+	}
+
+	if store != nil {
+		// All returns the most recently seen peers first, so those are the ones kept
+		for _, kp := range store.All() {
+			if len(pm.addrs) >= maxKnownAddresses {
+				break
+			}
+			pm.addrs[kp.Addr] = &outboundAddr{}
+		}
+	}
+	return pm
+}
+
+// Start starts the goroutine that keeps the outbound connections alive.
+func (pm *PeerManager) Start() {
+	pm.wg.Add(1)
+	go pm.connectionLoop()
+}
+
+// Stop disconnects every peer, and waits for all of their goroutines to finish.
+func (pm *PeerManager) Stop() {
+	close(pm.quit)
+
+	pm.mu.Lock()
+	for p := range pm.peers {
+		p.Close()
+	}
+	pm.mu.Unlock()
+
+	pm.wg.Wait()
+}
+
+// AddAddress adds an address that the manager should keep an outbound connection to. The address is also saved to the peer store.
+func (pm *PeerManager) AddAddress(addr string) {
+	pm.AddAddresses([]string{addr})
+}
+
+// AddAddresses adds many addresses like AddAddress does, and saves the new ones to the peer store in a single db transaction. Once the
+// manager knows about maxKnownAddresses addresses, the rest are ignored. It returns how many addresses were new.
+func (pm *PeerManager) AddAddresses(addrs []string) int {
+	var added []string
+
+	pm.mu.Lock()
+	for _, addr := range addrs {
+		if len(pm.addrs) >= maxKnownAddresses {
+			break
+		}
+		if _, ok := pm.addrs[addr]; ok {
+			continue
+		}
+		pm.addrs[addr] = &outboundAddr{}
+		added = append(added, addr)
+	}
+	pm.mu.Unlock()
+
+	if len(added) > 0 && pm.store != nil {
+		pm.store.AddAll(added)
+	}
+	return len(added)
+}
+
+// KnownAddresses returns every address the manager knows about.
+func (pm *PeerManager) KnownAddresses() []string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var addrs []string
+	for addr := range pm.addrs {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// AddInbound registers a connection that another node made to us, and starts reading from it.
+func (pm *PeerManager) AddInbound(conn net.Conn) *Peer {
+	p := newPeer(conn, conn.RemoteAddr().String(), true)
+	pm.addPeer(p)
+	return p
+}
+
+// Peers returns every connected peer.
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var peers []*Peer
+	for p := range pm.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Broadcast sends a message to every connected peer, except for the peer passed in as except.
+func (pm *PeerManager) Broadcast(command string, payload []byte, except *Peer) {
+	for _, p := range pm.Peers() {
+		if p != except {
+			p.Send(command, payload)
+		}
+	}
+}
+
+// addPeer registers a peer and starts its read and write goroutines. Once the peer disconnects, it's removed.
+func (pm *PeerManager) addPeer(p *Peer) {
+	pm.mu.Lock()
+	select {
+	case <-pm.quit:
+		pm.mu.Unlock()
+		p.Close()
+		return
+	default:
+	}
+	pm.peers[p] = struct{}{}
+	pm.wg.Add(2)
+	pm.mu.Unlock()
+
+	go func() {
+		defer pm.wg.Done()
+		p.writeLoop()
+	}()
+	go func() {
+		defer pm.wg.Done()
+		p.readLoop(pm.handler)
+		pm.removePeer(p)
+	}()
+}
+
+// removePeer forgets a disconnected peer. If it was an outbound peer, its address is retried after a backoff.
+func (pm *PeerManager) removePeer(p *Peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.peers, p)
+	if p.Inbound {
+		return
+	}
+	if a, ok := pm.addrs[p.Addr()]; ok && a.peer == p {
+		a.peer = nil
+		a.failures++
+		a.nextAttempt = time.Now().Add(reconnectBackoff(a.failures))
+	}
+}
+
+// connect dials addr and registers the new outbound peer. If the address can't be reached, its backoff is increased.
+func (pm *PeerManager) connect(addr string) *Peer {
+	conn, err := net.DialTimeout(protocol, addr, peerDialTimeout)
+
+	pm.mu.Lock()
+	a, ok := pm.addrs[addr]
+	if !ok {
+		a = &outboundAddr{}
+		pm.addrs[addr] = a
+	}
+	if err != nil {
+		a.failures++
+		a.nextAttempt = time.Now().Add(reconnectBackoff(a.failures))
+		pm.mu.Unlock()
+		fmt.Printf("%s is not available\n", addr)
+
+		// forget about peers that haven't been reachable for a long time
+		if pm.store != nil && pm.store.MarkFailed(addr) {
+			pm.mu.Lock()
+			delete(pm.addrs, addr)
+			pm.mu.Unlock()
+		}
+		return nil
+	}
+	// if another goroutine connected to the same address while we were dialing, keep that connection instead
+	if a.peer != nil {
+		pm.mu.Unlock()
+		conn.Close()
+		return a.peer
+	}
+	p := newPeer(conn, addr, false)
+	a.peer = p
+	a.failures = 0
+	pm.mu.Unlock()
+
+	pm.addPeer(p)
+	if pm.store != nil {
+		pm.store.MarkSeen(addr)
+	}
+	if pm.onOutbound != nil {
+		pm.onOutbound(p)
+	}
+	return p
+}
+
+// connectionLoop runs every connectInterval, and dials out to known addresses whose backoff has expired, until there are enough outbound peers.
+func (pm *PeerManager) connectionLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range pm.connectCandidates() {
+			pm.connect(addr)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-pm.quit:
+			return
+		}
+	}
+}
+
+// connectCandidates returns the addresses that should be dialed right now, so that we end up with targetOutbound outbound peers.
+func (pm *PeerManager) connectCandidates() []string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	outbound := 0
+	for p := range pm.peers {
+		if !p.Inbound {
+			outbound++
+		}
+	}
+
+	var candidates []string
+	now := time.Now()
+	for addr, a := range pm.addrs {
+		if outbound+len(candidates) >= pm.targetOutbound {
+			break
+		}
+		if a.peer != nil || now.Before(a.nextAttempt) || pm.connectedToLocked(addr) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	return candidates
+}
+
+// connectedToLocked checks whether any peer, inbound or outbound, listens on addr. pm.mu must be held.
+func (pm *PeerManager) connectedToLocked(addr string) bool {
+	for p := range pm.peers {
+		if p.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectBackoff doubles the time to wait before redialing an address for every failure in a row, up to maxReconnectBackoff.
+func reconnectBackoff(failures int) time.Duration {
+	backoff := minReconnectBackoff
+	for i := 1; i < failures && backoff < maxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,148 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	peersBucket = "peersBucket"
+	// maxPeerFailures is how many times in a row we can fail to connect to a peer, before it's forgotten.
+	maxPeerFailures = 10
+	// maxAddrsPerMessage is the most addresses sent in a single addr message.
+	maxAddrsPerMessage = 1000
+	// maxKnownAddresses is the most addresses we keep track of. Addresses other nodes tell us about past it are ignored, so that a single
+	// node can't flood us with addresses to store and dial.
+	maxKnownAddresses = 2000
+	// minAddrInterval is how long a peer has to wait between two addr messages. The ones it sends sooner are ignored.
+	minAddrInterval = 1 * time.Minute
+)
+
+// KnownPeer is a peer that we've heard about, either from a seed, or from another node. It's stored in the peersBucket, so that a restarted
+// node can reconnect to the network without needing a seed node.
+type KnownPeer struct {
+	Addr     string // Addr is the address the peer listens on, i.e localhost:3000
+	LastSeen int64  // LastSeen is the unix time we last connected to the peer, or 0 if we never did.
+	Failures int    // Failures is the number of failed connection attempts in a row.
+}
+
+// PeerStore keeps track of every known peer, in the same bolt db as the blockchain.
+type PeerStore struct {
+	DB *bolt.DB
+}
+
+// NewPeerStore returns a PeerStore, creating the peersBucket if it doesn't exist yet.
+func NewPeerStore(db *bolt.DB) (*PeerStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(peersBucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PeerStore{DB: db}, nil
+}
+
+// AddAll stores every peer we don't know about already, in a single db transaction.
+func (ps *PeerStore) AddAll(addrs []string) {
+	err := ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peersBucket))
+
+		for _, addr := range addrs {
+			if b.Get([]byte(addr)) != nil {
+				continue
+			}
+			err := b.Put([]byte(addr), KnownPeer{Addr: addr}.Serialize()); if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); if err != nil {
+		fmt.Println("error adding known peers", err)
+	}
+}
+
+// MarkSeen records that we just connected to the peer, and resets its failures.
+func (ps *PeerStore) MarkSeen(addr string) {
+	ps.update(addr, func(kp *KnownPeer) bool {
+		kp.LastSeen = time.Now().Unix()
+		kp.Failures = 0
+		return true
+	})
+}
+
+// MarkFailed records a failed connection attempt. Once a peer fails maxPeerFailures times in a row, it's removed, and MarkFailed returns true.
+func (ps *PeerStore) MarkFailed(addr string) bool {
+	removed := false
+	ps.update(addr, func(kp *KnownPeer) bool {
+		kp.Failures++
+		removed = kp.Failures >= maxPeerFailures
+		return !removed
+	})
+	return removed
+}
+
+// All returns every known peer, the most recently seen first.
+func (ps *PeerStore) All() []KnownPeer {
+	var known []KnownPeer
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peersBucket))
+		return b.ForEach(func(k, v []byte) error {
+			known = append(known, deserializeKnownPeer(v))
+			return nil
+		})
+	}); if err != nil {
+		fmt.Println("error reading known peers", err)
+	}
+
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].LastSeen > known[j].LastSeen
+	})
+	return known
+}
+
+// update loads a peer (or a new one if it's unknown), and passes it to fn. If fn returns true the peer is saved, otherwise it's deleted.
+func (ps *PeerStore) update(addr string, fn func(kp *KnownPeer) bool) {
+	err := ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peersBucket))
+
+		kp := KnownPeer{Addr: addr}
+		if v := b.Get([]byte(addr)); v != nil {
+			kp = deserializeKnownPeer(v)
+		}
+
+		if !fn(&kp) {
+			return b.Delete([]byte(addr))
+		}
+		return b.Put([]byte(addr), kp.Serialize())
+	}); if err != nil {
+		fmt.Println("error updating known peer", addr, err)
+	}
+}
+
+// Serialize encodes a known peer to be stored in the peersBucket.
+func (kp KnownPeer) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(kp); if err != nil {
+		fmt.Println("error serializing known peer", err)
+	}
+	return buff.Bytes()
+}
+
+func deserializeKnownPeer(data []byte) KnownPeer {
+	var kp KnownPeer
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&kp); if err != nil {
+		fmt.Println("error decoding known peer", err)
+	}
+	return kp
+}
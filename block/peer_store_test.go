@@ -0,0 +1,94 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testAddrs returns count different addresses, starting at port first.
+func testAddrs(first, count int) []string {
+	var addrs []string
+	for i := 0; i < count; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.1:%d", first+i))
+	}
+	return addrs
+}
+
+func TestKnownAddressCap(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	store, err := NewPeerStore(c.bc.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := NewPeerManager(0, store, nil, nil)
+
+	addrs := testAddrs(1, maxKnownAddresses+500)
+	if added := pm.AddAddresses(addrs[:10]); added != 10 {
+		t.Errorf("AddAddresses added %d new addresses, want 10", added)
+	}
+	if added := pm.AddAddresses(addrs); added != maxKnownAddresses-10 {
+		t.Errorf("AddAddresses added %d new addresses, want %d", added, maxKnownAddresses-10)
+	}
+	if known := len(pm.KnownAddresses()); known != maxKnownAddresses {
+		t.Errorf("manager knows %d addresses, want %d", known, maxKnownAddresses)
+	}
+	if stored := len(store.All()); stored != maxKnownAddresses {
+		t.Errorf("store has %d addresses, want %d", stored, maxKnownAddresses)
+	}
+
+	// a store that grew past the cap, i.e before there was one, only has the cap's worth loaded
+	store.AddAll(testAddrs(maxKnownAddresses+500, 500))
+	if known := len(NewPeerManager(0, store, nil, nil).KnownAddresses()); known != maxKnownAddresses {
+		t.Errorf("manager loaded %d stored addresses, want %d", known, maxKnownAddresses)
+	}
+}
+
+func TestAllowAddr(t *testing.T) {
+	p := &Peer{}
+	now := time.Now()
+
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{now, true},
+		{now.Add(time.Second), false},
+		{now.Add(minAddrInterval - time.Second), false},
+		{now.Add(minAddrInterval), true},
+		{now.Add(minAddrInterval + time.Second), false},
+	}
+	for i, tt := range tests {
+		if got := p.allowAddr(tt.at); got != tt.want {
+			t.Errorf("addr message %d: allowAddr returned %t, want %t", i, got, tt.want)
+		}
+	}
+}
+
+func TestHandleAddr(t *testing.T) {
+	c, n, p := newTestNode(t)
+	defer c.close()
+	n.peers = NewPeerManager(0, nil, nil, nil)
+
+	// our own address and empty ones are dropped, and only maxAddrsPerMessage addresses of a message are looked at
+	addrs := append([]string{n.address, ""}, testAddrs(1, maxAddrsPerMessage+100)...)
+	n.handleAddr(p, GobEncode(Addr{Addrs: addrs}))
+	if known := len(n.peers.KnownAddresses()); known != maxAddrsPerMessage {
+		t.Errorf("node knows %d addresses, want %d", known, maxAddrsPerMessage)
+	}
+
+	// the same peer sending more right away is ignored
+	more := testAddrs(maxAddrsPerMessage+1000, 10)
+	n.handleAddr(p, GobEncode(Addr{Addrs: more}))
+	if known := len(n.peers.KnownAddresses()); known != maxAddrsPerMessage {
+		t.Errorf("node knows %d addresses after a second addr message right away, want %d", known, maxAddrsPerMessage)
+	}
+
+	p.lastAddr = time.Now().Add(-minAddrInterval)
+	n.handleAddr(p, GobEncode(Addr{Addrs: more}))
+	if known := len(n.peers.KnownAddresses()); known != maxAddrsPerMessage+len(more) {
+		t.Errorf("node knows %d addresses after waiting out the interval, want %d", known, maxAddrsPerMessage+len(more))
+	}
+}
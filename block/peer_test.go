@@ -0,0 +1,145 @@
+package block
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it's true, and fails the test if it takes longer than a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// outboundState returns the failures and the next attempt of a known address.
+func (pm *PeerManager) outboundState(addr string) (int, time.Time) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	a := pm.addrs[addr]
+	return a.failures, a.nextAttempt
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, minReconnectBackoff},
+		{1, minReconnectBackoff},
+		{2, 2 * minReconnectBackoff},
+		{3, 4 * minReconnectBackoff},
+		{9, 256 * minReconnectBackoff},
+		{10, maxReconnectBackoff},
+		{1000, maxReconnectBackoff},
+	}
+	for _, tt := range tests {
+		if got := reconnectBackoff(tt.failures); got != tt.want {
+			t.Errorf("reconnectBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestPeerManagerOutbound(t *testing.T) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	pm := NewPeerManager(1, nil, func(p *Peer, command string, payload []byte) {}, nil)
+	defer pm.Stop()
+	pm.AddAddress(addr)
+	if got := pm.connectCandidates(); len(got) != 1 || got[0] != addr {
+		t.Fatalf("connect candidates are %v, want [%s]", got, addr)
+	}
+
+	p := pm.connect(addr)
+	if p == nil {
+		t.Fatal("can't connect to a listening address")
+	}
+	remote, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := pm.Peers(); len(peers) != 1 || peers[0] != p || p.Inbound {
+		t.Fatalf("peers are %v, want the outbound peer", peers)
+	}
+	if got := pm.connectCandidates(); len(got) != 0 {
+		t.Errorf("connect candidates are %v while the only address is connected", got)
+	}
+
+	// the peer disconnecting removes it, and its address is retried after the backoff
+	remote.Close()
+	waitFor(t, "the peer to be removed", func() bool { return len(pm.Peers()) == 0 })
+	failures, next := pm.outboundState(addr)
+	if failures != 1 || time.Until(next) <= 0 || time.Until(next) > minReconnectBackoff {
+		t.Errorf("after a disconnect the address has %d failures and is retried in %s, want 1 and %s", failures, time.Until(next), minReconnectBackoff)
+	}
+	if got := pm.connectCandidates(); len(got) != 0 {
+		t.Errorf("connect candidates are %v before the backoff expired", got)
+	}
+
+	// reconnecting resets the failures
+	pm.mu.Lock()
+	pm.addrs[addr].nextAttempt = time.Now()
+	pm.mu.Unlock()
+	if got := pm.connectCandidates(); len(got) != 1 {
+		t.Fatalf("connect candidates are %v after the backoff expired", got)
+	}
+	if pm.connect(addr) == nil {
+		t.Fatal("can't reconnect")
+	}
+	if failures, _ := pm.outboundState(addr); failures != 0 {
+		t.Errorf("address has %d failures after reconnecting, want 0", failures)
+	}
+}
+
+func TestPeerManagerUnreachable(t *testing.T) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	pm := NewPeerManager(1, nil, nil, nil)
+	defer pm.Stop()
+	pm.AddAddress(addr)
+
+	for want := 1; want <= 3; want++ {
+		if pm.connect(addr) != nil {
+			t.Fatal("connected to an address nothing listens on")
+		}
+		failures, next := pm.outboundState(addr)
+		if failures != want || time.Until(next) > reconnectBackoff(want) || time.Until(next) <= reconnectBackoff(want)/2 {
+			t.Errorf("after %d failed dials the address has %d failures and is retried in %s, want %s", want, failures, time.Until(next), reconnectBackoff(want))
+		}
+	}
+	if len(pm.Peers()) != 0 {
+		t.Error("an unreachable address was registered as a peer")
+	}
+}
+
+func TestPeerManagerInbound(t *testing.T) {
+	pm := NewPeerManager(1, nil, func(p *Peer, command string, payload []byte) {}, nil)
+	defer pm.Stop()
+
+	local, remote := net.Pipe()
+	p := pm.AddInbound(local)
+	if peers := pm.Peers(); len(peers) != 1 || peers[0] != p || !p.Inbound {
+		t.Fatalf("peers are %v, want the inbound peer", peers)
+	}
+
+	remote.Close()
+	waitFor(t, "the peer to be removed", func() bool { return len(pm.Peers()) == 0 })
+	if addrs := pm.KnownAddresses(); len(addrs) != 0 {
+		t.Errorf("an inbound peer's address was added as an outbound candidate: %v", addrs)
+	}
+}
@@ -0,0 +1,270 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+// A blockchain isn't always a single chain. When two miners find a block at the same time, both blocks point to the same parent, and the chain
+// forks into two branches. Every block of every branch is stored, but only one branch is the main chain, the one "l" points to. The main chain is
+// the branch with the most cumulative work, meaning the branch that took the most hashing to build. Once a side branch gets more work than the
+// main chain, the chain reorganizes: the blocks of the old main chain are disconnected back to where the branches split, and the blocks of the
+// side branch are connected in their place.
+
+const (
+	chainWorkBucket = "chainWorkBucket"
+)
+
+var (
+	errUnknownParent = errors.New("block's parent is unknown")
+	errBadHeight     = errors.New("block's height doesn't follow its parent's height")
+)
+
+// TipChange describes how the main chain changed after a block was added.
+type TipChange struct {
+	Disconnected []*Block // Disconnected are the blocks that left the main chain, the old tip first.
+	Connected    []*Block // Connected are the blocks that joined the main chain, the oldest first. The last one is the new tip.
+}
+
+// AddBlock validates and stores a block received from another node. If the block's branch now has more work than the main chain, the blocks
+// that join the main chain are validated against the UTXO set, the block's branch becomes the main chain, and the change is returned. If the
+// block ends up on a side branch, or is already stored, nil is returned. A block whose parent we don't have returns errUnknownParent. A block
+// that fails validation leaves the main chain as it was, and it's remembered as invalid, along with every block built on top of it.
+// Storing the block and moving the UTXO set and the tail to its branch happen in a single db transaction, so a stored block is never left
+// with more work than the tail after a crash.
+func (bc *Blockchain) AddBlock(block *Block) (*TipChange, error) {
+	var (
+		change  *TipChange
+		invalid []*Block
+	)
+
+	err := checkBlockSanity(block); if err != nil {
+		return nil, err
+	}
+
+	err = bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		if b.Get(block.Hash) != nil {
+			return nil
+		}
+
+		if len(block.PrevBlockHash) == 0 || b.Get(block.PrevBlockHash) == nil {
+			return errUnknownParent
+		}
+		if isInvalid(tx, block.Hash) || isInvalid(tx, block.PrevBlockHash) {
+			return errInvalidBlock
+		}
+		parent, err := getHeader(tx, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		err = checkHeaderContext(tx, block.Header(), parent)
+		if err != nil {
+			return err
+		}
+
+		work, err := storeHeader(tx, block.Header())
+		if err != nil {
+			return err
+		}
+		err = b.Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+
+		tipHash := append([]byte{}, b.Get([]byte("l"))...)
+		tipWork, err := chainWork(tx, tipHash)
+		if err != nil {
+			return err
+		}
+
+		// ties go to the branch we saw first
+		if work.Cmp(tipWork) <= 0 {
+			fmt.Printf("Block %x is on a side branch\n", block.Hash)
+			return nil
+		}
+
+		change, err = findTipChange(b, tipHash, block)
+		if err != nil {
+			return err
+		}
+		if len(change.Disconnected) > 0 {
+			fmt.Printf("Reorganizing the chain, %d blocks disconnected and %d connected\n", len(change.Disconnected), len(change.Connected))
+		}
+		invalid, err = moveUTXOSet(tx, change)
+		return err
+	})
+
+	// the db transaction was rolled back, so the invalid blocks are remembered in one of their own
+	for _, blk := range invalid {
+		bc.markInvalid(blk.Hash)
+	}
+	if err != nil || change == nil {
+		return nil, err
+	}
+
+	bc.setTip(change.Connected[len(change.Connected)-1].Hash)
+	return change, nil
+}
+
+// moveUTXOSet rolls the UTXO set back over the disconnected blocks using their undo records, and then forward over the connected blocks,
+// validating each one's transactions right before it's connected, and stores the new tip, within a db transaction. If a disconnected block has
+// no undo record, the UTXO set is rebuilt up to the block where the branches split instead, and the connected blocks are validated on top of
+// it all the same. If a block turns out to be invalid, its error is returned along with the block and every block after it, which the
+// caller has to mark as invalid once the db transaction is rolled back.
+func moveUTXOSet(tx *bolt.Tx, change *TipChange) ([]*Block, error) {
+	for _, disconnected := range change.Disconnected {
+		err := disconnectBlock(tx, disconnected); if errors.Is(err, errNoUndoRecord) {
+			fmt.Println("can't roll back the UTXO set, rebuilding it up to the fork:", err)
+			err = rebuildUTXOSet(tx, change.Connected[0].PrevBlockHash); if err != nil {
+				return nil, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, connected := range change.Connected {
+		err := checkBlockTransactions(tx, connected); if err != nil {
+			fmt.Printf("block %x is invalid: %s\n", connected.Hash, err)
+			// the blocks after it build on it, so they're invalid too
+			return change.Connected[i:], err
+		}
+		err = connectBlock(tx, connected); if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, putTip(tx, change.Connected[len(change.Connected)-1].Hash)
+}
+
+// findTipChange walks back from the current tip and the new block, until both walks meet at the block where the branches split.
+func findTipChange(b *bolt.Bucket, tipHash []byte, newBlock *Block) (*TipChange, error) {
+	change := &TipChange{}
+
+	oldBlk, err := getBlock(b, tipHash)
+	if err != nil {
+		return nil, err
+	}
+	newBlk := newBlock
+
+	for oldBlk.Height > newBlk.Height {
+		change.Disconnected = append(change.Disconnected, oldBlk)
+		if oldBlk, err = getBlock(b, oldBlk.PrevBlockHash); err != nil {
+			return nil, err
+		}
+	}
+	for newBlk.Height > oldBlk.Height {
+		change.Connected = append(change.Connected, newBlk)
+		if newBlk, err = getBlock(b, newBlk.PrevBlockHash); err != nil {
+			return nil, err
+		}
+	}
+	for !bytes.Equal(oldBlk.Hash, newBlk.Hash) {
+		change.Disconnected = append(change.Disconnected, oldBlk)
+		change.Connected = append(change.Connected, newBlk)
+		if oldBlk, err = getBlock(b, oldBlk.PrevBlockHash); err != nil {
+			return nil, err
+		}
+		if newBlk, err = getBlock(b, newBlk.PrevBlockHash); err != nil {
+			return nil, err
+		}
+	}
+
+	// Connected was built from the new tip backwards, but blocks have to be connected oldest first
+	for i, j := 0, len(change.Connected)-1; i < j; i, j = i+1, j-1 {
+		change.Connected[i], change.Connected[j] = change.Connected[j], change.Connected[i]
+	}
+	return change, nil
+}
+
+// getBlock reads a block from the blocks bucket within a transaction.
+func getBlock(b *bolt.Bucket, hash []byte) (*Block, error) {
+	encBlock := b.Get(hash)
+	if encBlock == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return DeserializeBlock(encBlock), nil
+}
+
+// headerWork returns how many hashes it takes on average to mine a block: 2^256 / (target+1). The smaller the target, the more work.
+func headerWork(h BlockHeader) *big.Int {
+	target := h.Target()
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// putChainWork stores the cumulative work of the branch ending at hash.
+func putChainWork(tx *bolt.Tx, hash []byte, work *big.Int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(hash, work.Bytes())
+}
+
+// chainWork returns the cumulative work of the branch ending at hash. Chains created before cumulative work was stored don't have it, so it's
+// worked out from the closest header that has it (or from genesis), and stored along the way. tx must be writable.
+func chainWork(tx *bolt.Tx, hash []byte) (*big.Int, error) {
+	workBucket, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket))
+	if err != nil {
+		return nil, err
+	}
+	if w := workBucket.Get(hash); w != nil {
+		return new(big.Int).SetBytes(w), nil
+	}
+
+	// walk back until a header with known work, keeping every header without it
+	var missing []BlockHeader
+	work := big.NewInt(0)
+	current := hash
+	for {
+		blk, err := getHeader(tx, current)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, blk)
+
+		if len(blk.PrevBlockHash) == 0 {
+			break
+		}
+		if w := workBucket.Get(blk.PrevBlockHash); w != nil {
+			work.SetBytes(w)
+			break
+		}
+		current = blk.PrevBlockHash
+	}
+
+	// then add up the work going forward again
+	for i := len(missing) - 1; i >= 0; i-- {
+		work = new(big.Int).Add(work, headerWork(missing[i]))
+		err := workBucket.Put(missing[i].Hash, work.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return work, nil
+}
+
+// retryTransactions puts the transactions of disconnected blocks back in the mempool, so that they can be mined again on the new main chain.
+// Transactions that the new main chain already spent are rejected by the mempool and dropped.
+func (n *Node) retryTransactions(change *TipChange) {
+	for _, blk := range change.Disconnected {
+		for _, tx := range blk.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			err := n.mempool.Add(*tx, UTXOSet{Blockchain: n.bc}); if err != nil {
+				fmt.Printf("dropped transaction %s of a disconnected block: %s\n", hex.EncodeToString(tx.ID), err)
+			}
+		}
+	}
+}
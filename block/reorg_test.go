@@ -0,0 +1,71 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReorgToHeavierBranch(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	n := NewNode(Config{})
+	n.bc = c.bc
+	receiver := NewWallet()
+
+	genesis, err := c.bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := c.spend(t, c.owner.PrivateKey, []TXInput{c.genesisInput(t, c.owner.PublicKey)},
+		NewTXOutput(4, string(receiver.GetAddress())), NewTXOutput(BlockSubsidy(0)-4, string(c.owner.GetAddress())))
+	main := c.mine(t, []*Transaction{spend}, 0, nil)
+	err = c.bc.AppendBlock(main); if err != nil {
+		t.Fatal(err)
+	}
+
+	// spends the main block's coinbase, which the other branch doesn't have
+	orphaned := c.spend(t, c.owner.PrivateKey, []TXInput{{Txid: main.Transactions[0].ID, Vout: 0, PubKey: c.owner.PublicKey}},
+		NewTXOutput(BlockSubsidy(1), string(receiver.GetAddress())))
+	err = n.mempool.Add(*orphaned, UTXOSet{Blockchain: c.bc}); if err != nil {
+		t.Fatal(err)
+	}
+
+	// a block is mined on top of its parent's target, so the parent has to be stored first
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	side := c.mineOn(t, genesis, "side", nil, 0, nil)
+	n.processBlock(nil, side)
+	if !bytes.Equal(c.bc.TipHash(), main.Hash) {
+		t.Error("a branch with as much work as the main chain took over")
+	}
+	heavier := c.mineOn(t, side, "side", nil, 0, nil)
+	n.processBlock(nil, heavier)
+
+	if !bytes.Equal(c.bc.TipHash(), heavier.Hash) {
+		t.Fatal("the heavier branch didn't take over")
+	}
+	for height, want := range []*Block{genesis, side, heavier} {
+		blk, err := c.bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(blk.Hash, want.Hash) {
+			t.Errorf("block at height %d is %x, want %x", height, blk.Hash, want.Hash)
+		}
+	}
+
+	if got := c.balance(receiver); got != 0 {
+		t.Errorf("receiver's balance is %d, want 0", got)
+	}
+	if want := BlockSubsidy(0) + BlockSubsidy(1) + BlockSubsidy(2); c.balance(c.owner) != want {
+		t.Errorf("owner's balance is %d, want %d", c.balance(c.owner), want)
+	}
+
+	if !n.mempool.Has(spend.ID) {
+		t.Error("the disconnected block's transaction wasn't put back in the mempool")
+	}
+	if n.mempool.Has(orphaned.ID) {
+		t.Error("a transaction that spends a disconnected coinbase is still in the mempool")
+	}
+}
@@ -3,25 +3,13 @@ package block
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"net"
+	"time"
 )
 
 const (
 	protocol = "tcp"
 	nodeVersion = 1
-	commandLength = 12
-)
-
-var (
-	nodeAddress string
-	// hardcoded central node
-	knownNodes      = []string{"localhost:3000"}
-	miningAddress   string
-	blocksInTransit [][]byte
-	mempool = make(map[string]Transaction)
 )
 
 type Version struct {
@@ -30,8 +18,16 @@ type Version struct {
 	AddrFrom string
 }
 
-type GetBlocks struct {
+// GetHeaders asks a node for the headers that come after the first block in Locator that's on its main chain.
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+// Headers is the answer to GetHeaders. The headers are in order, oldest first.
+type Headers struct {
 	AddrFrom string
+	Headers  []BlockHeader
 }
 
 type Inv struct {
@@ -40,168 +36,488 @@ type Inv struct {
 	Items [][]byte
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress); if err != nil {
-		panic(err)
-	}
-	defer ln.Close()
+type GetData struct {
+	AddrFrom string
+	Type string
+	ID []byte
+}
 
-	bc := NewBlockChain(nodeID)
+type BlockMsg struct {
+	AddrFrom string
+	Block []byte
+}
 
-	// if this address is not the central node
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
-	}
+type TxMsg struct {
+	AddrFrom string
+	Transaction []byte
+}
 
-	for {
-		conn, err := ln.Accept(); if err != nil {
-			panic(err)
-		}
-		go handleConnection(conn, bc)
-	}
+type GetAddr struct {
+	AddrFrom string
 }
 
-func sendVersion(addr string, bc *Blockchain)  {
-	bestHeight := bc.GetBestHeight()
+type Addr struct {
+	AddrFrom string
+	Addrs []string
+}
+
+func (n *Node) sendVersion(p *Peer) {
+	bestHeight := n.bc.GetBestHeight()
 	payload := GobEncode(Version{
 		Version:    nodeVersion,
 		BestHeight: bestHeight,
-		AddrFrom:   nodeAddress,
+		AddrFrom:   n.address,
+	})
+
+	p.Send("version", payload)
+}
+
+// sendGetAddr asks a node for every address it knows about. The node will answer with an addr message.
+func (n *Node) sendGetAddr(p *Peer) {
+	payload := GobEncode(GetAddr{AddrFrom: n.address})
+	p.Send("getaddr", payload)
+}
+
+// sendAddr sends a node a list of addresses that we know about.
+func (n *Node) sendAddr(p *Peer, addrs []string) {
+	payload := GobEncode(Addr{
+		AddrFrom: n.address,
+		Addrs:    addrs,
+	})
+	p.Send("addr", payload)
+}
+
+// sendGetHeaders asks a node for the headers that come after our best header. The node will answer with a headers message.
+func (n *Node) sendGetHeaders(p *Peer) {
+	payload := GobEncode(GetHeaders{
+		AddrFrom: n.address,
+		Locator:  n.bc.BlockLocator(),
+	})
+	p.Send("getheaders", payload)
+}
+
+// sendHeaders sends a node a list of headers.
+func (n *Node) sendHeaders(p *Peer, headers []BlockHeader) {
+	payload := GobEncode(Headers{
+		AddrFrom: n.address,
+		Headers:  headers,
+	})
+	p.Send("headers", payload)
+}
+
+// invPayload encodes an inv message, which lets nodes know which blocks or transactions we have. kind is either "block" or "tx". The same
+// payload is broadcast to every peer.
+func (n *Node) invPayload(kind string, items [][]byte) []byte {
+	return GobEncode(Inv{
+		AddrFrom: n.address,
+		Type:     kind,
+		Items:    items,
+	})
+}
+
+// sendGetData requests a single block or transaction by its hash/ID.
+func (n *Node) sendGetData(p *Peer, kind string, id []byte) {
+	payload := GobEncode(GetData{
+		AddrFrom: n.address,
+		Type:     kind,
+		ID:       id,
+	})
+	p.Send("getdata", payload)
+}
+
+// sendBlock sends a full serialized block to a node.
+func (n *Node) sendBlock(p *Peer, b *Block) {
+	payload := GobEncode(BlockMsg{
+		AddrFrom: n.address,
+		Block:    b.Serialize(),
 	})
+	p.Send("block", payload)
+}
 
-	request := append(commandToBytes("version"), payload...)
-	sendData(addr, request)
+// sendTx sends a full serialized transaction to a node.
+func (n *Node) sendTx(p *Peer, tx *Transaction) {
+	payload := GobEncode(TxMsg{
+		AddrFrom:    n.address,
+		Transaction: tx.Serialize(),
+	})
+	p.Send("tx", payload)
 }
 
-func handleInv(request []byte, bc *Blockchain) {
+func (n *Node) handleInv(p *Peer, payload []byte) {
 	var (
 		buff bytes.Buffer
-		payload Inv
+		msg Inv
 	)
 
-	buff.Write(request[commandLength:])
+	buff.Write(payload)
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload); if err != nil {
+	err := dec.Decode(&msg); if err != nil {
 		fmt.Println("error decoding into payload for get blocks handler", err)
 		return
 	}
 
-	fmt.Printf("Recieved inventory with %d %s\n", len(payload.Items), payload.Type)
-
-	if payload.Type == "block" {
-		var newInTransit [][]byte
+	fmt.Printf("Recieved inventory with %d %s\n", len(msg.Items), msg.Type)
 
-		blocksInTransit = payload.Items
+	// a new block was announced. Its header is fetched first, and the block is downloaded once the header checks out.
+	if msg.Type == "block" {
+		for _, item := range msg.Items {
+			if !n.bc.HasHeader(item) {
+				n.sendGetHeaders(p)
+				return
+			}
+		}
+	}
 
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	if msg.Type == "tx" {
+		if len(msg.Items) == 0 {
+			return
+		}
+		txID := msg.Items[0]
 
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
-			}
+		if !n.mempool.Has(txID) {
+			n.sendGetData(p, "tx", txID)
 		}
-		blocksInTransit = newInTransit
 	}
+}
 
-	if payload.Type == "tx" {
-		txID := payload.Items[0]
+// handleGetData answers a getdata request with the block or transaction that was asked for.
+func (n *Node) handleGetData(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg GetData
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for get data handler", err)
+		return
+	}
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+	if msg.Type == "block" {
+		blk, err := n.bc.GetBlock(msg.ID); if err != nil {
+			fmt.Println("error finding requested block", err)
+			return
 		}
+		n.sendBlock(p, blk)
+	}
+
+	if msg.Type == "tx" {
+		tx, ok := n.mempool.Get(msg.ID); if !ok {
+			return
+		}
+		n.sendTx(p, &tx)
 	}
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
+// handleBlock adds a block received from another node to the chain. A block whose parent we don't have yet waits in the orphan pool, until
+// its parent is downloaded.
+func (n *Node) handleBlock(p *Peer, payload []byte) {
 	var (
 		buff bytes.Buffer
-		payload GetBlocks
+		msg BlockMsg
 	)
 
-	buff.Write(request[commandLength:])
+	buff.Write(payload)
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload); if err != nil {
-		fmt.Println("error decoding into payload for get blocks handler", err)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for block handler", err)
+		return
+	}
+
+	blk, err := decodeBlock(msg.Block); if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Recieved a new block %x\n", blk.Hash)
+
+	n.chainMu.Lock()
+	err = n.processBlock(p, blk)
+	n.chainMu.Unlock()
+
+	// the peer's height is only trusted once its block checks out
+	if err == nil {
+		p.setHeight(blk.Height)
+	}
+
+	n.blockArrived(blk.Hash)
+}
+
+// processBlock adds a block to the chain, followed by every orphan that was waiting on it, and every orphan waiting on those, and so on. It
+// returns the error adding blk returned, which is errUnknownParent if blk is an orphan. n.chainMu must be held.
+func (n *Node) processBlock(p *Peer, blk *Block) error {
+	var blkErr error
+	queue := []*Block{blk}
+
+	for len(queue) > 0 {
+		b := queue[0]
+		queue = queue[1:]
+
+		change, err := n.bc.AddBlock(b)
+		if b == blk {
+			blkErr = err
+		}
+		if err == errUnknownParent {
+			n.addOrphan(p, b)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("error adding block %x: %s\n", b.Hash, err)
+			continue
+		}
+
+		if change != nil {
+			for _, connected := range change.Connected {
+				n.mempool.RemoveBlock(connected)
+			}
+			// outputs of the disconnected blocks are gone from the UTXO set, so mempool transactions that spend them can't be mined anymore
+			if len(change.Disconnected) > 0 {
+				n.mempool.Revalidate(UTXOSet{Blockchain: n.bc})
+			}
+			n.retryTransactions(change)
+			// a block from another node became our tip, so whatever we're mining is outdated
+			n.cancelMining()
+			n.relayBlocks(change, p)
+		}
+
+		queue = append(queue, n.orphans.TakeChildren(b.Hash)...)
+	}
+	return blkErr
+}
+
+// relayBlocks announces the blocks that joined the main chain to every peer, except the one that sent them. Without it, a block would only
+// travel a single hop away from the node that mined it.
+func (n *Node) relayBlocks(change *TipChange, from *Peer) {
+	if n.peers == nil {
 		return
 	}
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	var hashes [][]byte
+	for _, blk := range change.Connected {
+		hashes = append(hashes, blk.Hash)
+	}
+	n.peers.Broadcast("inv", n.invPayload("block", hashes), from)
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+// addOrphan puts a block whose parent we don't have in the orphan pool. Unless the oldest ancestor we're missing is already being downloaded,
+// it's requested from the peer that sent the block.
+func (n *Node) addOrphan(p *Peer, blk *Block) {
+	if len(blk.PrevBlockHash) == 0 {
+		fmt.Printf("dropped block %x, it's the genesis block of another chain\n", blk.Hash)
+		return
+	}
+	if !n.orphans.Add(blk) {
+		return
+	}
+	fmt.Printf("Block %x is an orphan, %d blocks are waiting for their parent\n", blk.Hash, n.orphans.Count())
+
+	missing := n.orphans.MissingAncestor(blk)
+	if !n.isDownloading(missing) {
+		n.sendGetData(p, "block", missing)
+	}
+}
+
+// handleTx validates a transaction received from another node, and adds it to the mempool. If it's valid and we haven't seen it before,
+// it's passed on to every other peer.
+func (n *Node) handleTx(p *Peer, payload []byte) {
 	var (
 		buff bytes.Buffer
-		payload Version
+		msg TxMsg
 	)
 
-	buff.Write(request[commandLength:])
+	buff.Write(payload)
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload); if err != nil {
-		fmt.Println("error decoding into payload for version handler", err)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for tx handler", err)
 		return
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	tx := DeserializeTransaction(msg.Transaction)
 
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	// the UTXO set can't change while the transaction is checked against it
+	n.chainMu.Lock()
+	err = n.mempool.Add(tx, UTXOSet{Blockchain: n.bc})
+	n.chainMu.Unlock()
+
+	if err != nil {
+		fmt.Printf("rejected transaction %x: %s\n", tx.ID, err)
+		return
 	}
+	n.signalMiner()
 
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	// pass the transaction on to every other peer, so that it reaches the whole network
+	n.peers.Broadcast("inv", n.invPayload("tx", [][]byte{tx.ID}), p)
+}
+
+// handleGetHeaders answers a getheaders message with the headers on our main chain that come after the other node's locator.
+func (n *Node) handleGetHeaders(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg GetHeaders
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for get headers handler", err)
+		return
 	}
+
+	headers := n.bc.HeadersAfter(msg.Locator, maxHeadersPerMessage)
+	n.sendHeaders(p, headers)
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn); if err != nil {
-		fmt.Println("error handling connection", err)
+// handleHeaders checks and stores the headers another node sent us, and starts downloading their blocks. If the node sent as many headers as
+// it's allowed to, it probably has more, so we ask for the next batch.
+func (n *Node) handleHeaders(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg Headers
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for headers handler", err)
+		return
+	}
+
+	fmt.Printf("Recieved %d headers\n", len(msg.Headers))
+	if len(msg.Headers) == 0 {
+		return
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("Recieved %s command\n", command)
 
-	switch command {
-	case "version":
-		handleVersion(request, bc)
-	default:
-		fmt.Println("unknown command", command)
+	err = n.bc.AddHeaders(msg.Headers); if err != nil {
+		// a single bad header means the rest of the chain can't be trusted either
+		fmt.Printf("rejected headers from %s: %s\n", p.Addr(), err)
+		n.headersArrived()
+		return
 	}
+	p.setHeight(msg.Headers[len(msg.Headers)-1].Height)
+	n.logSyncProgress()
 
-	conn.Close()
+	if len(msg.Headers) >= maxHeadersPerMessage {
+		n.sendGetHeaders(p)
+	}
+	n.headersArrived()
 }
 
-func commandToBytes(command string) []byte {
-	var bytes [commandLength]byte
+func (n *Node) handleVersion(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg Version
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for version handler", err)
+		return
+	}
+
+	myBestHeight := n.bc.GetBestHeight()
+	foreignerBestHeight := msg.BestHeight
+	p.setHeight(foreignerBestHeight)
 
-	for i, c := range command {
-		bytes[i] = byte(c)
+	if n.bc.BestHeader().Height < foreignerBestHeight {
+		n.sendGetHeaders(p)
+	} else if myBestHeight > foreignerBestHeight {
+		n.sendVersion(p)
 	}
 
-	return bytes[:]
+	// inbound peers connect from a random port, so their version is the first time we learn the address they listen on
+	if p.Inbound {
+		p.setAddr(msg.AddrFrom)
+	}
+	n.addAddress(msg.AddrFrom)
 }
 
-func bytesToCommand(bytes []byte) string {
-	var command []byte
+// handleGetAddr answers a getaddr message with the addresses of every peer we know about.
+func (n *Node) handleGetAddr(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg GetAddr
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for get addr handler", err)
+		return
+	}
 
-	for _, b := range bytes {
-		if b != 0x0 {
-			command = append(command, b)
+	var addrs []string
+	for _, addr := range n.peers.KnownAddresses() {
+		if addr != msg.AddrFrom && len(addrs) < maxAddrsPerMessage {
+			addrs = append(addrs, addr)
 		}
 	}
-	return fmt.Sprintf("%s", command)
+	n.sendAddr(p, addrs)
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
+// handleAddr adds every address another node told us about to our known peers. A peer that sends addr messages more often than every
+// minAddrInterval is ignored until the interval is up.
+func (n *Node) handleAddr(p *Peer, payload []byte) {
+	var (
+		buff bytes.Buffer
+		msg Addr
+	)
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&msg); if err != nil {
+		fmt.Println("error decoding into payload for addr handler", err)
+		return
+	}
+
+	if !p.allowAddr(time.Now()) {
+		fmt.Printf("ignored addresses from %s, it sent some less than %s ago\n", p.Addr(), minAddrInterval)
+		return
+	}
+
+	var addrs []string
+	for _, addr := range msg.Addrs {
+		if len(addrs) >= maxAddrsPerMessage {
+			break
+		}
+		if addr != "" && addr != n.address {
+			addrs = append(addrs, addr)
 		}
 	}
-	return false
-}
\ No newline at end of file
+	added := n.peers.AddAddresses(addrs)
+	fmt.Printf("Recieved %d addresses, %d of them new\n", len(msg.Addrs), added)
+}
+
+// handleMessage passes a message read from a peer to the handler for its command.
+func (n *Node) handleMessage(p *Peer, command string, payload []byte) {
+	switch command {
+	case "version":
+		n.handleVersion(p, payload)
+	case "getheaders":
+		n.handleGetHeaders(p, payload)
+	case "headers":
+		n.handleHeaders(p, payload)
+	case "inv":
+		n.handleInv(p, payload)
+	case "getdata":
+		n.handleGetData(p, payload)
+	case "block":
+		n.handleBlock(p, payload)
+	case "tx":
+		n.handleTx(p, payload)
+	case "getaddr":
+		n.handleGetAddr(p, payload)
+	case "addr":
+		n.handleAddr(p, payload)
+	default:
+		fmt.Println("unknown command", command)
+	}
+}
+
+// addAddress adds an address to the known peers, unless it's our own address.
+func (n *Node) addAddress(addr string) {
+	if addr == "" || addr == n.address {
+		return
+	}
+	n.peers.AddAddress(addr)
+}
@@ -0,0 +1,75 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+)
+
+// newTestNode returns a node on top of a test chain, without starting it, along with a peer whose messages are never read.
+func newTestNode(t *testing.T) (*testChain, *Node, *Peer) {
+	c := newTestChain(t)
+	n := NewNode(Config{})
+	n.bc = c.bc
+
+	conn, _ := net.Pipe()
+	return c, n, newPeer(conn, "peer", true)
+}
+
+func TestHandleBlockHeight(t *testing.T) {
+	c, n, p := newTestNode(t)
+	defer c.close()
+
+	invalid := c.mine(t, nil, 1000, nil)
+	n.handleBlock(p, GobEncode(BlockMsg{Block: invalid.Serialize()}))
+	if p.Height() != 0 {
+		t.Errorf("peer's height is %d after it sent an invalid block, want 0", p.Height())
+	}
+
+	valid := c.mine(t, nil, 0, nil)
+	n.handleBlock(p, GobEncode(BlockMsg{Block: valid.Serialize()}))
+	if p.Height() != valid.Height {
+		t.Errorf("peer's height is %d after it sent a valid block, want %d", p.Height(), valid.Height)
+	}
+}
+
+func TestRelayBlocks(t *testing.T) {
+	c, n, sender := newTestNode(t)
+	defer c.close()
+
+	conn, _ := net.Pipe()
+	other := newPeer(conn, "other", true)
+	n.peers = NewPeerManager(0, nil, nil, nil)
+	n.peers.peers[sender] = struct{}{}
+	n.peers.peers[other] = struct{}{}
+
+	blk := c.mine(t, nil, 0, nil)
+	n.handleBlock(sender, GobEncode(BlockMsg{Block: blk.Serialize()}))
+
+	if len(sender.send) != 0 {
+		t.Error("the block was relayed back to the peer that sent it")
+	}
+	if len(other.send) != 1 {
+		t.Fatalf("%d messages were sent to the other peer, want 1", len(other.send))
+	}
+	msg := <-other.send
+	var inv Inv
+	err := gob.NewDecoder(bytes.NewReader(msg.payload)).Decode(&inv); if err != nil {
+		t.Fatal(err)
+	}
+	if msg.command != "inv" || inv.Type != "block" || len(inv.Items) != 1 || !bytes.Equal(inv.Items[0], blk.Hash) {
+		t.Errorf("the other peer got %s %s %x, want an inv of the new block", msg.command, inv.Type, inv.Items)
+	}
+
+	// a block on a side branch doesn't change the main chain, so it isn't relayed
+	genesis, err := c.bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := c.mineOn(t, genesis, "side", nil, 0, nil)
+	n.handleBlock(sender, GobEncode(BlockMsg{Block: side.Serialize()}))
+	if len(other.send) != 0 {
+		t.Error("a block on a side branch was relayed")
+	}
+}
@@ -0,0 +1,98 @@
+package block
+
+// New coins only come into existence through the coinbase of every block. The amount a coinbase can pay, the subsidy, starts at
+// initialSubsidy and is cut in half every halvingInterval blocks, so the coins are issued quickly at first, and slower and slower as the chain
+// grows. On top of that, the coins ever issued can't go past maxSupply. The block that reaches it only pays what's left, and every block after it
+// pays nothing but the fees of its transactions.
+
+const (
+	// initialSubsidy is what the coinbase of the blocks before the first halving pays.
+	initialSubsidy = 10
+	// halvingInterval is how many blocks go by before the subsidy is cut in half.
+	halvingInterval = 210000
+	// maxSupply is the most coins that will ever exist.
+	maxSupply = 3500000
+)
+
+// SubsidyEra is a stretch of blocks that all pay the same subsidy.
+type SubsidyEra struct {
+	StartHeight int // StartHeight is the height of the era's first block.
+	EndHeight   int // EndHeight is the height of the era's last block.
+	Subsidy     int // Subsidy is what every block in the era pays, except maybe for the last one, which can be capped by maxSupply.
+	Issued      int // Issued is the total coins issued once the era is over, counting every era before it.
+}
+
+// BlockSubsidy returns the subsidy of the block at height.
+func BlockSubsidy(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	issued := TotalIssued(height - 1)
+	subsidy := halvedSubsidy(height)
+	if issued+subsidy > maxSupply {
+		subsidy = maxSupply - issued
+	}
+	return subsidy
+}
+
+// TotalIssued returns how many coins were issued by the blocks from genesis up to, and including, the block at height.
+func TotalIssued(height int) int {
+	issued := 0
+
+	for start := 0; start <= height; start += halvingInterval {
+		subsidy := halvedSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		blocks := halvingInterval
+		if height-start+1 < blocks {
+			blocks = height - start + 1
+		}
+		issued += blocks * subsidy
+		if issued >= maxSupply {
+			return maxSupply
+		}
+	}
+	return issued
+}
+
+// MaxSupply returns the most coins that will ever exist.
+func MaxSupply() int {
+	return maxSupply
+}
+
+// EmissionSchedule returns every era that pays a subsidy, from genesis until the last coin is issued.
+func EmissionSchedule() []SubsidyEra {
+	var eras []SubsidyEra
+
+	for start := 0; halvedSubsidy(start) > 0; start += halvingInterval {
+		end := start + halvingInterval - 1
+		era := SubsidyEra{
+			StartHeight: start,
+			EndHeight:   end,
+			Subsidy:     halvedSubsidy(start),
+			Issued:      TotalIssued(end),
+		}
+
+		// the era that reaches maxSupply ends with the block that issues the last coin
+		if era.Issued == maxSupply {
+			era.EndHeight = start + (maxSupply-TotalIssued(start-1)+era.Subsidy-1)/era.Subsidy - 1
+			eras = append(eras, era)
+			break
+		}
+		eras = append(eras, era)
+	}
+	return eras
+}
+
+// halvedSubsidy returns the subsidy at height going by the halvings alone, without the maxSupply cap.
+func halvedSubsidy(height int) int {
+	halvings := uint(height / halvingInterval)
+	// shifting by the size of an int or more isn't a halving anymore
+	if halvings >= 63 {
+		return 0
+	}
+	return initialSubsidy >> halvings
+}
@@ -0,0 +1,91 @@
+package block
+
+import "testing"
+
+func TestBlockSubsidyHalvings(t *testing.T) {
+	tests := []struct {
+		height int
+		want   int
+	}{
+		{-1, 0},
+		{0, initialSubsidy},
+		{halvingInterval - 1, initialSubsidy},
+		{halvingInterval, initialSubsidy / 2},
+		{2*halvingInterval - 1, initialSubsidy / 2},
+		{2 * halvingInterval, initialSubsidy / 4},
+		// two eras issue 3150000 coins, so the last 350000 take 175000 blocks of the third era, and nothing is left for the fourth
+		{2*halvingInterval + 175000 - 1, initialSubsidy / 4},
+		{2*halvingInterval + 175000, 0},
+		{3 * halvingInterval, 0},
+		{64 * halvingInterval, 0},
+	}
+	for _, tt := range tests {
+		if got := BlockSubsidy(tt.height); got != tt.want {
+			t.Errorf("BlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestTotalIssued(t *testing.T) {
+	tests := []struct {
+		height int
+		want   int
+	}{
+		{-1, 0},
+		{0, initialSubsidy},
+		{halvingInterval - 1, halvingInterval * initialSubsidy},
+		{halvingInterval, halvingInterval*initialSubsidy + initialSubsidy/2},
+	}
+	for _, tt := range tests {
+		if got := TotalIssued(tt.height); got != tt.want {
+			t.Errorf("TotalIssued(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+
+	// adding up every subsidy, one block at a time, has to agree with TotalIssued, and never go past maxSupply
+	issued := 0
+	for _, era := range EmissionSchedule() {
+		for _, height := range []int{era.StartHeight, era.EndHeight} {
+			if TotalIssued(height) > maxSupply {
+				t.Fatalf("TotalIssued(%d) = %d, which is past maxSupply", height, TotalIssued(height))
+			}
+		}
+		for height := era.StartHeight; height <= era.EndHeight; height++ {
+			issued += BlockSubsidy(height)
+		}
+		if issued != era.Issued || issued != TotalIssued(era.EndHeight) {
+			t.Fatalf("the blocks up to height %d issue %d, but the era says %d and TotalIssued says %d", era.EndHeight, issued, era.Issued, TotalIssued(era.EndHeight))
+		}
+	}
+	if issued != maxSupply {
+		t.Errorf("the emission schedule issues %d, want maxSupply", issued)
+	}
+}
+
+func TestEmissionSchedule(t *testing.T) {
+	eras := EmissionSchedule()
+	if len(eras) == 0 {
+		t.Fatal("the emission schedule is empty")
+	}
+
+	for i, era := range eras {
+		if era.StartHeight != i*halvingInterval {
+			t.Errorf("era %d starts at %d, want %d", i, era.StartHeight, i*halvingInterval)
+		}
+		if era.Subsidy != initialSubsidy>>uint(i) || era.Subsidy <= 0 {
+			t.Errorf("era %d pays %d, want %d", i, era.Subsidy, initialSubsidy>>uint(i))
+		}
+		if era.Issued > maxSupply {
+			t.Errorf("era %d ends with %d issued, which is past maxSupply", i, era.Issued)
+		}
+	}
+
+	// once the last era is over, no block pays a subsidy anymore
+	last := eras[len(eras)-1]
+	if BlockSubsidy(last.EndHeight+1) != 0 {
+		t.Errorf("the block after the last era pays %d", BlockSubsidy(last.EndHeight+1))
+	}
+	if TotalIssued(last.EndHeight+halvingInterval) != last.Issued {
+		t.Errorf("coins are issued after the last era")
+	}
+}
@@ -0,0 +1,229 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// maxBlocksInFlight is the most blocks requested at once, from all peers together. It's kept below maxOrphanBlocks, since blocks that arrive
+	// before their parent wait in the orphan pool.
+	maxBlocksInFlight = 64
+	// maxBlocksInFlightPerPeer is the most blocks requested at once from a single peer.
+	maxBlocksInFlightPerPeer = 16
+	// blockDownloadTimeout is how long to wait for a requested block, before asking another peer for it.
+	blockDownloadTimeout = 30 * time.Second
+	// syncInterval is how often the sync loop checks for blocks to request and requests that timed out.
+	syncInterval = 1 * time.Second
+)
+
+// Syncing is done headers first. When a peer has a longer chain, we send it a getheaders message with a block locator (see BlockLocator). The
+// peer finds where our chains split, and sends back the headers after that point. Each header's proof of work is checked as it arrives, so a
+// bogus chain is rejected before any of its blocks are downloaded. Once the headers are stored, the blocks they belong to are requested from
+// every peer that has them, a few at a time from each, so that a long chain downloads in parallel. Headers are kept in the db, so a node that
+// restarts in the middle of syncing picks up right where it stopped.
+
+// blockRequest is a block that was requested from a peer, and hasn't arrived yet.
+type blockRequest struct {
+	header   BlockHeader
+	peer     *Peer
+	deadline time.Time
+}
+
+// blockDownloader keeps track of which blocks still have to be downloaded, and which peer each requested block was asked from.
+type blockDownloader struct {
+	pending  []BlockHeader            // pending are the headers of blocks that weren't requested yet, oldest first
+	inFlight map[string]*blockRequest // inFlight maps the hex hash of every requested block to its request
+	perPeer  map[*Peer]int            // perPeer counts the blocks in flight from each peer
+}
+
+func newBlockDownloader() *blockDownloader {
+	return &blockDownloader{
+		inFlight: make(map[string]*blockRequest),
+		perPeer:  make(map[*Peer]int),
+	}
+}
+
+// syncLoop requests blocks every syncInterval. Most blocks are requested as soon as headers or blocks arrive, the loop is there to retry
+// requests that timed out, and to start downloading after a restart.
+func (n *Node) syncLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		n.requestBlocks()
+
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requestBlocks requests as many missing blocks as it's allowed to. Every block is requested from the peer with the least blocks in flight,
+// out of the peers whose chain is long enough to have it. Requests that timed out, or whose peer disconnected, are requested again.
+func (n *Node) requestBlocks() {
+	connected := make(map[*Peer]bool)
+	for _, p := range n.peers.Peers() {
+		connected[p] = true
+	}
+
+	n.mu.Lock()
+	d := n.downloader
+
+	var retry []BlockHeader
+	now := time.Now()
+	for hash, req := range d.inFlight {
+		if connected[req.peer] && now.Before(req.deadline) {
+			continue
+		}
+		retry = append(retry, req.header)
+		d.removeLocked(hash)
+	}
+	if len(retry) > 0 {
+		sort.Slice(retry, func(i, j int) bool {
+			return retry[i].Height < retry[j].Height
+		})
+		d.pending = append(retry, d.pending...)
+	}
+
+	needsRefill := len(d.pending) == 0 && len(d.inFlight) == 0
+	n.mu.Unlock()
+
+	// reading the missing blocks goes through the db, so it's done without holding n.mu
+	if needsRefill {
+		missing := n.bc.MissingBlocks()
+		if len(missing) == 0 {
+			return
+		}
+		n.mu.Lock()
+		d.pending = n.notDownloadingLocked(missing)
+		n.mu.Unlock()
+	}
+
+	type getData struct {
+		peer *Peer
+		hash []byte
+	}
+	var requests []getData
+
+	n.mu.Lock()
+	for len(d.pending) > 0 && len(d.inFlight) < maxBlocksInFlight {
+		h := d.pending[0]
+
+		// the block may have arrived some other way in the meantime
+		if n.orphans.Has(h.Hash) {
+			d.pending = d.pending[1:]
+			continue
+		}
+
+		var best *Peer
+		for p := range connected {
+			if p.Height() < h.Height || d.perPeer[p] >= maxBlocksInFlightPerPeer {
+				continue
+			}
+			if best == nil || d.perPeer[p] < d.perPeer[best] {
+				best = p
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		d.pending = d.pending[1:]
+		d.inFlight[hex.EncodeToString(h.Hash)] = &blockRequest{header: h, peer: best, deadline: now.Add(blockDownloadTimeout)}
+		d.perPeer[best]++
+		requests = append(requests, getData{peer: best, hash: h.Hash})
+	}
+	n.mu.Unlock()
+
+	for _, r := range requests {
+		n.sendGetData(r.peer, "block", r.hash)
+	}
+}
+
+// blockArrived marks a block as downloaded, and requests more blocks to take its place.
+func (n *Node) blockArrived(hash []byte) {
+	n.mu.Lock()
+	_, ok := n.downloader.inFlight[hex.EncodeToString(hash)]
+	n.downloader.removeLocked(hex.EncodeToString(hash))
+	n.mu.Unlock()
+
+	if ok {
+		n.requestBlocks()
+	}
+}
+
+// headersArrived replaces the blocks waiting to be requested with the blocks missing from the best header chain, which may have just changed.
+func (n *Node) headersArrived() {
+	missing := n.bc.MissingBlocks()
+
+	n.mu.Lock()
+	n.downloader.pending = n.notDownloadingLocked(missing)
+	n.mu.Unlock()
+
+	n.requestBlocks()
+}
+
+// isDownloading checks whether a block is waiting to be requested, or was requested and didn't arrive yet.
+func (n *Node) isDownloading(hash []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.downloader.inFlight[hex.EncodeToString(hash)]; ok {
+		return true
+	}
+	for _, h := range n.downloader.pending {
+		if bytes.Equal(h.Hash, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// notDownloadingLocked filters out the headers whose block was already requested. n.mu must be held.
+func (n *Node) notDownloadingLocked(headers []BlockHeader) []BlockHeader {
+	var pending []BlockHeader
+	for _, h := range headers {
+		if _, ok := n.downloader.inFlight[hex.EncodeToString(h.Hash)]; !ok {
+			pending = append(pending, h)
+		}
+	}
+	return pending
+}
+
+// removeLocked forgets a request. n.mu must be held.
+func (d *blockDownloader) removeLocked(hash string) {
+	req, ok := d.inFlight[hash]
+	if !ok {
+		return
+	}
+	delete(d.inFlight, hash)
+
+	d.perPeer[req.peer]--
+	if d.perPeer[req.peer] <= 0 {
+		delete(d.perPeer, req.peer)
+	}
+}
+
+// reset forgets every pending and requested block.
+func (d *blockDownloader) reset() {
+	d.pending = nil
+	d.inFlight = make(map[string]*blockRequest)
+	d.perPeer = make(map[*Peer]int)
+}
+
+// logSyncProgress prints how far along the sync is.
+func (n *Node) logSyncProgress() {
+	best := n.bc.BestHeader()
+	height := n.bc.GetBestHeight()
+	if best.Height > height {
+		fmt.Printf("Syncing, have block %d of %d\n", height, best.Height)
+	}
+}
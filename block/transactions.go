@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
@@ -13,6 +14,18 @@ import (
 	"os"
 )
 
+// A coinbase transaction has no real input to spend, so its input's PubKey holds data instead. The data starts with the height of the block the
+// coinbase is in, followed by the extra-nonce miners change once they run out of nonces, followed by the miner's tag, which can be anything.
+// Since the height is part of the data, two coinbases that pay the same miner still get different IDs.
+const (
+	// coinbaseHeightLen is how many bytes the height takes up at the start of the coinbase data.
+	coinbaseHeightLen = 8
+	// coinbaseExtraNonceLen is how many bytes the extra-nonce takes up, right after the height.
+	coinbaseExtraNonceLen = 8
+	// maxCoinbaseDataLen is the most bytes of data a coinbase can have, height and extra-nonce included.
+	maxCoinbaseDataLen = 100
+)
+
 // Transaction represents a single transaction
 type Transaction struct {
 	ID   []byte // ID of the transaction. It's how its identified.
@@ -25,20 +38,29 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-// NewCoinbaseTX creates a new transaction for the initial genesis block
-func NewCoinbaseTX(to, data string) *Transaction {
+// NewCoinbaseTX creates the coinbase transaction of the block at height, which pays that block's subsidy, plus fees, to the address to.
+// fees has to be the total fees of the block's other transactions, a coinbase that claims more makes the block invalid. data is the miner's tag,
+// it's cut short if it doesn't fit in maxCoinbaseDataLen.
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
 
+	cbData := make([]byte, coinbaseHeightLen+coinbaseExtraNonceLen, maxCoinbaseDataLen)
+	binary.BigEndian.PutUint64(cbData, uint64(height))
+	cbData = append(cbData, data...)
+	if len(cbData) > maxCoinbaseDataLen {
+		cbData = cbData[:maxCoinbaseDataLen]
+	}
+
 	txin := TXInput{
 		Txid:      []byte{},
 		Vout:      -1,
 		Signature: nil,
-		PubKey:    []byte(data),
+		PubKey:    cbData,
 	}
 
-	txout := NewTXOutput(subsidy, to)
+	txout := NewTXOutput(BlockSubsidy(height)+fees, to)
 
 	tx := Transaction{
 		ID:   nil,
@@ -50,6 +72,15 @@ func NewCoinbaseTX(to, data string) *Transaction {
 	return &tx
 }
 
+// CoinbaseHeight returns the block height a coinbase transaction commits to. It returns false if the transaction isn't a coinbase, or its
+// data is too short to hold a height.
+func (tx Transaction) CoinbaseHeight() (int, bool) {
+	if !tx.IsCoinbase() || len(tx.Vin[0].PubKey) < coinbaseHeightLen {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint64(tx.Vin[0].PubKey)), true
+}
+
 // Serialize serializes an entire transaction. Used when inserting a transaction into a boltDB bucket, or when hashing.
 func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
@@ -61,76 +92,58 @@ func (tx Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
-// Hash hashes a transaction, to be used for setting a transaction's ID.
+// DeserializeTransaction decodes a serialized transaction.
+func DeserializeTransaction(data []byte) Transaction {
+	var tx Transaction
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&tx); if err != nil {
+		fmt.Println("error decoding transaction", err)
+	}
+	return tx
+}
+
+// Hash hashes a transaction, to be used for setting a transaction's ID. It's also the hash that gets signed, see Sign.
+// The ID isn't part of what's hashed. The transaction isn't hashed in its gob form, since gob doesn't encode the same transaction to the same
+// bytes in every process, and every node has to come up with the same hash to check a signature.
 func(tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
-	// When serializing a transaction, remove the transaction ID. Used to make a trimmed copy for signing
-	// see if u can avoid this step, by removing the pointer
-	txCopy := *tx
-	txCopy.ID = []byte{}
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash = sha256.Sum256(tx.hashData())
 
 	return hash[:]
 }
 
-// FindUnspentTransactions loops over every block in a blockchain. For every transaction, it checks for unspent transactions.
-// For every Output in a transaction, check if that output was already "spent"/referenced by an input. The first/tail block will always be
-// nil since no outputs have been referenced. Then add the transaction to the UTXOs map if unreferenced. The next time the loops runs, when it looks for
-// free outputs, if they are on that map they are definitely not free.
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
-	UTXOs := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-	blockIdx := 0
-	for {
-		fmt.Println("block idx #", blockIdx)
-		// iterate over every block
-		block := bci.Next()
-		blockIdx++
-
-		// iterate over every transaction in a block
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				fmt.Println("SpentTXOs: ", spentTXOs)
-				// Was the output spent?
-				// If that transaction id is in spentTXOs, verify that the spent output idx isn't that of the outputs index.
-				// i.e: transaction B has two outputs [0,1], spentTXOs stored that transaction B has spentOutIdx (tx B's output index) 0 as spent. If the index (outIdx)
-				// is 0, that means it's referencing the spent output 0, so skip it. It will find the next spentOutIdx as unspent since it's not referenced in spentTXOs.
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							fmt.Printf("Output #%d was already referenced\n", outIdx)
-							continue Outputs
-						}
-					}
-				}
-				// if the output is not referenced, add it to UTXOs
-				outs := UTXOs[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXOs[txID] = outs
-			}
-			// if tx is coinbase, skip this since it has no inputs that reference outputs
-			if !tx.IsCoinbase() {
-				// spentTXOs starts off blank, since the tail block always has open outputs
-				// if an input references an output, then that input is spent
-				// the reason why we don't just add every referenced output to spentTXOs, is that only the ones that can be unlocked are relevant, and
-				// will be detected when searching for outputs. If we didn't list those as taken, we would think they were spendable.
-				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					fmt.Println("appending tx id: ", inTxID)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-				}
-			}
-		}
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+// hashData lays out a transaction's inputs and outputs one after the other, every field in a fixed format: numbers are 8 bytes big endian,
+// and byte slices are prefixed with their length.
+func (tx *Transaction) hashData() []byte {
+	var buff bytes.Buffer
+
+	writeInt := func(n int64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		buff.Write(b[:])
+	}
+	writeBytes := func(data []byte) {
+		writeInt(int64(len(data)))
+		buff.Write(data)
+	}
+
+	writeInt(int64(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		writeBytes(vin.Txid)
+		writeInt(int64(vin.Vout))
+		writeBytes(vin.Signature)
+		writeBytes(vin.PubKey)
+	}
+
+	writeInt(int64(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		writeInt(int64(vout.Value))
+		writeBytes(vout.PubKeyHash)
 	}
-	return UTXOs
+
+	return buff.Bytes()
 }
 
 // New UTXOTransaction makes a transaction from address a to address b. It first gets a list of which outputs have address a's coins. If there aren't enough
@@ -138,13 +151,14 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 // the output that has address a's coins. Then create an output that has the amount being transferred, and lock it to address b.
 // If there are too many coins on the output, i.e address a wants to send 5 and the output has 10, create another output locked to address a, and store the remainder of
 // the coins on that new output. Finally, using the newly created input and output(s), return a transaction that can then be stored in a block.
-func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// The fee isn't an output of its own. Whatever the inputs hold that isn't sent or returned as change is the fee, and the miner of the block claims it.
+func NewUTXOTransaction(from, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
 	var (
 		inputs  []TXInput
 		outputs []TXOutput
 	)
 
-	wallets, err := NewWallets()
+	wallets, err := NewWallets(UTXOSet.Blockchain.DataDir)
 	if err != nil {
 		panic(err)
 	}
@@ -152,9 +166,9 @@ func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transact
 	// HashPubKey returns only the public key hashed with RIPEMD160 and SHA256, it doesn't add the version or checksum
 	pubKeyHash := HashPubKey(wallet.PublicKey)
 
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
 
-	if acc < amount {
+	if acc < amount+fee {
 		fmt.Println("ERROR: Not enough funds")
 		// TODO: fix this
 		os.Exit(1)
@@ -181,8 +195,8 @@ func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transact
 	// build a list of outputs
 	// notice that when we transfer the amount, we lock it to the address it's being sent to. When the output is the remainder of the value sent, it's locked to the sender.
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // if its not exactly the amount, create change. For example if its 30 and he only needed 25
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // if its not exactly the amount, create change. For example if its 30 and he only needed 25
 	}
 
 	tx := Transaction{
@@ -191,8 +205,12 @@ func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transact
 		Vout: outputs,
 	}
 
+	err = UTXOSet.SignTransaction(&tx, wallet.PrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	// the ID covers the signatures, so that nobody can change a signature without changing the ID, and the block the transaction is in
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 	return &tx
 }
 
@@ -209,20 +227,30 @@ func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transact
 // while the prevTXs is map holding transactions that contain outputs. Those outputs are the outputs that the transaction you are calling this method from has
 // referenced.
 func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+	err := tx.SignOutputs(privateKey, prevOutputs(tx, prevTXs)); if err != nil {
+		panic(err)
+	}
+}
+
+// SignOutputs signs a transaction like Sign does, but takes only the outputs its inputs spend, keyed by their outpoint (see outpointKey),
+// instead of the whole transactions they belong to. It returns an error if one of them is missing.
+func (tx *Transaction) SignOutputs(privateKey ecdsa.PrivateKey, prevOuts map[string]TXOutput) error {
 	// CP transactions don't have real inputs and therefore are not signed
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	txCopy := tx.TrimmedCopy()
 
 	for inID, vin := range txCopy.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
+		prevOut, ok := prevOuts[outpointKey(vin.Txid, vin.Vout)]; if !ok {
+			return fmt.Errorf("output %x:%d that input %d spends is missing", vin.Txid, vin.Vout, inID)
+		}
 		// just to double check that sig is nil
 		txCopy.Vin[inID].Signature = nil
 		// Set the public key to the value of the senders public key.
 		// i.e: john sends money to dave, the public key here would be johns
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
 		// Set the ID of the trimmed copy equal to the hashed trimmed copy.
 		txCopy.ID = txCopy.Hash()
 		// After the hash is created, remove the public key for safety
@@ -230,13 +258,29 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Tran
 
 		// r and s are key pairs that make up a signature
 		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID); if err != nil {
-			panic(err)
+			return err
 		}
 		// concatenate them together to make a full signature
-		signature := append(r.Bytes(),s.Bytes()...)
+		signature := concatPadded(r, s, keyPartLength)
 
 		tx.Vin[inID].Signature = signature
 	}
+	return nil
+}
+
+// prevOutputs picks the outputs that tx's inputs spend out of prevTXs, keyed by their outpoint (see outpointKey). Inputs whose output isn't
+// in prevTXs are left out.
+func prevOutputs(tx *Transaction, prevTXs map[string]Transaction) map[string]TXOutput {
+	prevOuts := make(map[string]TXOutput)
+
+	for _, vin := range tx.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			continue
+		}
+		prevOuts[outpointKey(vin.Txid, vin.Vout)] = prevTx.Vout[vin.Vout]
+	}
+	return prevOuts
 }
 
 // TrimmedCopy removes the Signature and PubKey from a transaction and sets them to nil. We don't need to sign the input keys, only the output keys
@@ -257,6 +301,12 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 // Verify is used to verify a transactions signature is valid. Like Sign, prevTXs is a map of transactions that contain the outputs that THE transaction's
 // inputs referenced.
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	return tx.VerifyOutputs(prevOutputs(tx, prevTXs))
+}
+
+// VerifyOutputs verifies a transaction's signatures like Verify does, but takes only the outputs its inputs spend, keyed by their outpoint
+// (see outpointKey). An input whose output is missing is invalid.
+func (tx *Transaction) VerifyOutputs(prevOuts map[string]TXOutput) bool {
 	// create a trimmed copy
 	txCopy := tx.TrimmedCopy()
 	// curve is the same curve used to generate the private key
@@ -264,9 +314,16 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for inID, vin := range tx.Vin {
 		// Same steps as Sign, as we need to generate the exact same trimmed transaction hash that we used for signing.
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		// an input that points at an output that doesn't exist can't be valid
+		prevOut, ok := prevOuts[outpointKey(vin.Txid, vin.Vout)]; if !ok {
+			return false
+		}
+		// a valid signature only proves the input was signed with vin.PubKey, so that key has to be the one the output is locked to
+		if !vin.UsesKey(prevOut.PubKeyHash) {
+			return false
+		}
 		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
 		txCopy.ID = txCopy.Hash()
 		txCopy.Vin[inID].PubKey = nil
 
@@ -0,0 +1,132 @@
+package block
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Finding a transaction by its ID used to mean reading every block from the tail back to genesis. The transaction index maps every transaction
+// on the main chain to the block it's in, and its position in the block, so that it takes a single lookup instead. The index is optional,
+// since it takes up room in the db for every transaction ever made. It's on when the txIndexBucket exists, and it's kept up to date every time
+// a block is connected to or disconnected from the UTXO set. The reindex command turns it on or off.
+
+const (
+	// txIndexBucket maps a transaction ID to the hash of its block, followed by its position in the block as 4 bytes big endian.
+	txIndexBucket = "txIndexBucket"
+)
+
+// HasTxIndex checks whether the transaction index is on.
+func (bc *Blockchain) HasTxIndex() bool {
+	var found bool
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(txIndexBucket)) != nil
+		return nil
+	}); if err != nil {
+		panic(err)
+	}
+	return found
+}
+
+// ReindexTransactions builds the transaction index from scratch, out of every block on the main chain, and turns it on. It returns how many
+// transactions were indexed.
+func (bc *Blockchain) ReindexTransactions() (int, error) {
+	count := 0
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(txIndexBucket)); if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte(txIndexBucket)); if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		hash := append([]byte{}, b.Get([]byte("l"))...)
+		for len(hash) > 0 {
+			blk, err := getBlock(b, hash)
+			if err != nil {
+				return err
+			}
+			err = indexBlockTransactions(tx, blk); if err != nil {
+				return err
+			}
+			count += len(blk.Transactions)
+			hash = blk.PrevBlockHash
+		}
+		return nil
+	})
+	return count, err
+}
+
+// DropTxIndex turns the transaction index off, and deletes it.
+func (bc *Blockchain) DropTxIndex() error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(txIndexBucket)); if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// indexBlockTransactions adds every transaction of a block that was just connected to the transaction index, if it's on.
+func indexBlockTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for pos, blockTx := range block.Transactions {
+		value := make([]byte, len(block.Hash)+4)
+		copy(value, block.Hash)
+		binary.BigEndian.PutUint32(value[len(block.Hash):], uint32(pos))
+
+		err := b.Put(blockTx.ID, value); if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBlockTransactions removes every transaction of a block that was just disconnected from the transaction index, if it's on.
+func unindexBlockTransactions(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return nil
+	}
+
+	for _, blockTx := range block.Transactions {
+		err := b.Delete(blockTx.ID); if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findIndexedTransaction looks up a transaction through the transaction index. It returns false if the index is off, and an error if the
+// index is on but the transaction isn't on the main chain.
+func findIndexedTransaction(tx *bolt.Tx, ID []byte) (Transaction, bool, error) {
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil {
+		return Transaction{}, false, nil
+	}
+
+	value := b.Get(ID)
+	if len(value) < 4 {
+		return Transaction{}, true, fmt.Errorf("transaction %x not found", ID)
+	}
+
+	hash := value[:len(value)-4]
+	pos := int(binary.BigEndian.Uint32(value[len(value)-4:]))
+
+	blk, err := getBlock(tx.Bucket([]byte(blocksBucket)), hash)
+	if err != nil {
+		return Transaction{}, true, err
+	}
+	if pos >= len(blk.Transactions) {
+		return Transaction{}, true, fmt.Errorf("transaction index points past the end of block %x", hash)
+	}
+	return *blk.Transactions[pos], true, nil
+}
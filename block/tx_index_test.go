@@ -0,0 +1,54 @@
+package block
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTxIndex(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	count, err := c.bc.ReindexTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || !c.bc.HasTxIndex() {
+		t.Fatalf("indexed %d transactions, want the genesis coinbase", count)
+	}
+	before := c.dumpBuckets(t, txIndexBucket)
+
+	receiver := NewWallet()
+	spend := c.spend(t, c.owner.PrivateKey, []TXInput{c.genesisInput(t, c.owner.PublicKey)}, NewTXOutput(BlockSubsidy(0), string(receiver.GetAddress())))
+	blk := c.mine(t, []*Transaction{spend}, 0, nil)
+	err = c.bc.AppendBlock(blk); if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := c.bc.FindTransaction(spend.ID)
+	if err != nil || !bytes.Equal(found.ID, spend.ID) {
+		t.Fatalf("can't find a transaction of a connected block through the index: %v", err)
+	}
+
+	// the index that was kept up to date while the block was connected is the same as one built from scratch
+	incremental := c.dumpBuckets(t, txIndexBucket)
+	_, err = c.bc.ReindexTransactions(); if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := c.dumpBuckets(t, txIndexBucket); !reflect.DeepEqual(incremental, rebuilt) {
+		t.Error("rebuilding the transaction index doesn't match the one kept up to date as blocks were connected")
+	}
+
+	err = UTXOSet{Blockchain: c.bc}.Disconnect(blk); if err != nil {
+		t.Fatal(err)
+	}
+	if after := c.dumpBuckets(t, txIndexBucket); !reflect.DeepEqual(before, after) {
+		t.Error("disconnecting a block didn't drop its transactions from the index")
+	}
+	for _, tx := range blk.Transactions {
+		if _, err := c.bc.FindTransaction(tx.ID); err == nil {
+			t.Errorf("transaction %x of a disconnected block is still found", tx.ID)
+		}
+	}
+}
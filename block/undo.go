@@ -0,0 +1,57 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const (
+	undoBucket = "undoBucket"
+)
+
+var errNoUndoRecord = errors.New("no undo record for block")
+
+// Once a block is connected, the outputs its transactions spent are gone from the utxoBucket. To be able to disconnect the block again, during a
+// reorg for example, Update stores an undo record for every block it connects, in the undoBucket keyed by the block's hash. The undo record keeps
+// every output the block spent, along with its outpoint, height and coinbase flag, so that Disconnect can put it back exactly as it was.
+
+// SpentOutput is a single output that was removed from the utxoBucket when a block was connected.
+type SpentOutput struct {
+	Txid  []byte    // Txid is the ID of the transaction the output belongs to.
+	Vout  int       // Vout is the output's index in its transaction's outputs.
+	Entry UTXOEntry // Entry is the removed output, as it was stored in the utxoBucket.
+}
+
+// TxUndo is everything needed to undo a single transaction of a block.
+type TxUndo struct {
+	Spent []SpentOutput // Spent are the outputs the transaction's inputs spent, in the order of the inputs.
+}
+
+// BlockUndo is the undo record of a block. It has a TxUndo for every transaction in the block, in the same order.
+type BlockUndo struct {
+	Txs []TxUndo
+}
+
+// Serialize encodes an undo record to be stored in the undoBucket.
+func (bu BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(bu); if err != nil {
+		panic(err)
+	}
+	return buff.Bytes()
+}
+
+// DeserializeBlockUndo decodes an undo record.
+func DeserializeBlockUndo(data []byte) (BlockUndo, error) {
+	var bu BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&bu); if err != nil {
+		return bu, fmt.Errorf("error decoding undo record: %w", err)
+	}
+	return bu, nil
+}
@@ -3,7 +3,9 @@ package block
 import (
 	"bytes"
 	"encoding/gob"
+	"math/big"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
@@ -12,14 +14,34 @@ func IntToHex(n int64) []byte {
 	return []byte(strconv.FormatInt(n, 16))
 }
 
-// DBExists checks whether bolt has a db created. If yes that means there is a blockchain already created
-func DBExists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+// DBExists checks whether bolt has a db created in dataDir. If yes that means there is a blockchain already created
+func DBExists(dataDir string) bool {
+	if _, err := os.Stat(dbPath(dataDir)); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
+// dbPath returns the path of the db file within a data directory. Every node has its own data directory, so that many nodes can run on one machine.
+func dbPath(dataDir string) string {
+	return filepath.Join(dataDir, dbFile)
+}
+
+// walletPath returns the path of the wallet file within a data directory.
+func walletPath(dataDir string) string {
+	return filepath.Join(dataDir, walletFile)
+}
+
+// concatPadded puts a and b one after the other, each padded with leading zeros to size bytes. Signatures and public keys are two numbers split
+// down the middle when they're read, so a number that happens to start with a zero byte would move the split if it wasn't padded.
+func concatPadded(a, b *big.Int, size int) []byte {
+	data := make([]byte, 2*size)
+	aBytes, bBytes := a.Bytes(), b.Bytes()
+	copy(data[size-len(aBytes):size], aBytes)
+	copy(data[2*size-len(bBytes):], bBytes)
+	return data
+}
+
 // ReverseBytes reverses a byte array
 func ReverseBytes(data []byte) {
 	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
@@ -31,7 +53,7 @@ func GobEncode(data interface{}) []byte{
 	var buff bytes.Buffer
 
 	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(&data); if err != nil {
+	err := enc.Encode(data); if err != nil {
 		panic(err)
 	}
 	return buff.Bytes()
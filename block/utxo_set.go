@@ -1,14 +1,30 @@
 package block
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"math"
+
 	"github.com/boltdb/bolt"
-	"strings"
 )
 
 const (
-	utxoBucket = "utxoBucket"
+	// utxoBucket stores every unspent output, keyed by its outpoint (see Outpoint.Key).
+	utxoBucket = "utxoSetBucket"
+	// addrIndexBucket indexes the utxoBucket by owner. It has a key for every unspent output, made of the public key hash the output is locked
+	// to, followed by the output's outpoint (see addrIndexKey). The values are empty.
+	addrIndexBucket = "addrIndexBucket"
+	// legacyUTXOBucket is where the UTXO set used to be stored, with every transaction's unspent outputs under the transaction's ID. Spending an
+	// output removed it from the list, which moved every output after it to a different index. It's deleted the next time the set is reindexed.
+	legacyUTXOBucket = "utxoBucket"
+	// utxoTipBucket holds a single "l" key, the hash of the block the UTXO set was last moved to. It's written in the same db transaction as
+	// the set itself, so if it doesn't match the tail of the chain, the set was left behind, i.e by a crash in the middle of a reindex, and
+	// has to be rebuilt.
+	utxoTipBucket = "utxoTipBucket"
 )
 
 // UTXOSet is a struct that contains only a reference to a blockchain instance.
@@ -20,158 +36,442 @@ type UTXOSet struct {
 // of needing to loop over transaction in every block, just to find the UTXO's. Reindex function is used to run through the entire blockchain and find UTXO's.
 // As you can imagine, this is a pretty memory intensive task the larger the chain gets, so we also have an Update function that is called every time an
 // output is referenced or created.
+// Every unspent output is stored on its own, under its outpoint: the ID of its transaction and its index in the transaction's outputs. Spending an
+// output deletes its key and nothing else, so the outputs left over keep the index their transaction gave them.
+
+// Outpoint identifies a single output by the ID of its transaction and its index in the transaction's outputs.
+type Outpoint struct {
+	Txid []byte
+	Vout int
+}
+
+// maxVout is the largest output index that fits in an outpoint's key.
+const maxVout = math.MaxUint32
+
+// Valid checks whether the outpoint's index fits in its key. An index outside of it would be cut down to 4 bytes, and end up with the key of
+// a different output, so Key must only be used on a valid outpoint.
+func (o Outpoint) Valid() bool {
+	return o.Vout >= 0 && int64(o.Vout) <= maxVout
+}
+
+// Key returns the outpoint's key in the utxoBucket: the transaction ID followed by the index as 4 bytes big endian. All the outputs of a
+// transaction sit next to each other, in order of their index.
+func (o Outpoint) Key() []byte {
+	key := make([]byte, len(o.Txid)+4)
+	copy(key, o.Txid)
+	binary.BigEndian.PutUint32(key[len(o.Txid):], uint32(o.Vout))
+	return key
+}
+
+// outpointFromKey decodes a key made by Outpoint.Key.
+func outpointFromKey(key []byte) Outpoint {
+	txid := append([]byte{}, key[:len(key)-4]...)
+	return Outpoint{Txid: txid, Vout: int(binary.BigEndian.Uint32(key[len(key)-4:]))}
+}
+
+// addrIndexKey returns an output's key in the addrIndexBucket. The public key hash is prefixed with its length, so that one public key hash can't
+// be the start of another. Outputs locked to an empty public key hash, or one longer than 255 bytes, can't be spent by any wallet, and aren't
+// indexed.
+func addrIndexKey(pubKeyHash []byte, op Outpoint) ([]byte, bool) {
+	if len(pubKeyHash) == 0 || len(pubKeyHash) > 255 {
+		return nil, false
+	}
+
+	key := append(addrIndexPrefix(pubKeyHash), op.Key()...)
+	return key, true
+}
+
+// addrIndexPrefix returns the start of the addrIndexBucket keys of every output locked to pubKeyHash.
+func addrIndexPrefix(pubKeyHash []byte) []byte {
+	prefix := make([]byte, 0, 1+len(pubKeyHash)+36)
+	prefix = append(prefix, byte(len(pubKeyHash)))
+	return append(prefix, pubKeyHash...)
+}
+
+// putUTXO adds an unspent output to the utxoBucket and the addrIndexBucket.
+func putUTXO(tx *bolt.Tx, op Outpoint, entry UTXOEntry) error {
+	err := tx.Bucket([]byte(utxoBucket)).Put(op.Key(), entry.Serialize()); if err != nil {
+		return err
+	}
+	if key, ok := addrIndexKey(entry.Output.PubKeyHash, op); ok {
+		return tx.Bucket([]byte(addrIndexBucket)).Put(key, []byte{})
+	}
+	return nil
+}
+
+// deleteUTXO removes an unspent output from the utxoBucket and the addrIndexBucket.
+func deleteUTXO(tx *bolt.Tx, op Outpoint, entry UTXOEntry) error {
+	err := tx.Bucket([]byte(utxoBucket)).Delete(op.Key()); if err != nil {
+		return err
+	}
+	if key, ok := addrIndexKey(entry.Output.PubKeyHash, op); ok {
+		return tx.Bucket([]byte(addrIndexBucket)).Delete(key)
+	}
+	return nil
+}
+
+// UTXOEntry is an unspent output, along with the height of the block that created it, and whether a coinbase transaction created it.
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// Serialize encodes an entry to be stored in the utxoBucket.
+func (e UTXOEntry) Serialize() []byte {
+	var buff bytes.Buffer
 
-// Reindex is used to reindex the chainstate. This is a pretty intensive task, so use wisely.
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(e); if err != nil {
+		panic(err)
+	}
+	return buff.Bytes()
+}
+
+// DeserializeUTXOEntry decodes an entry from the utxoBucket.
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var e UTXOEntry
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&e); if err != nil {
+		return e, fmt.Errorf("error decoding utxo entry: %w", err)
+	}
+	return e, nil
+}
+
+// Reindex is used to reindex the chainstate. This is a pretty intensive task, so use wisely. The set is rebuilt by connecting every block of the
+// main chain again, from genesis up to the tail, so every block gets its undo record back, and can still be disconnected in a reorg. If the
+// transaction index is on, it's rebuilt too, since Reindex is also used to move the UTXO set to a new main chain.
 func (u UTXOSet) Reindex()  {
-	db := u.Blockchain.DB
-	bucketName := []byte(utxoBucket)
-
-	// Delete the utxo bucket if it exists, and then recreate. Essentially empty out the bucket.
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName); if err != nil {
-			if !strings.Contains(err.Error(), "not found") {
-				fmt.Println("error deleting utxoBucket", err)
-			}
-		}
-		_, err = tx.CreateBucket(bucketName); if err != nil {
-			fmt.Println("error creating utxo bucket", err)
-		}
-		return nil
+	tip := u.Blockchain.TipHash()
+
+	err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		return rebuildUTXOSet(tx, tip)
 	}); if err != nil {
 		panic(err)
 	}
+}
 
-	// Get a list of utxo's mapped to their transaction's ID
-	UTXO := u.Blockchain.FindUTXO()
+// rebuildUTXOSet empties the UTXO set, its address index, the undo records and the transaction index, if it's on, and then connects every block
+// from genesis up to the block hash, within a db transaction. The blocks are read going back from hash, so hash doesn't have to be the tail of
+// the chain.
+func rebuildUTXOSet(tx *bolt.Tx, hash []byte) error {
+	rebuilt := []string{utxoBucket, addrIndexBucket, undoBucket}
+	if tx.Bucket([]byte(txIndexBucket)) != nil {
+		rebuilt = append(rebuilt, txIndexBucket)
+	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+	for _, name := range append(rebuilt, legacyUTXOBucket) {
+		err := tx.DeleteBucket([]byte(name)); if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	for _, name := range rebuilt {
+		_, err := tx.CreateBucket([]byte(name)); if err != nil {
+			return err
+		}
+	}
 
+	// only the headers are read on the way back, the blocks are read on the way forward
+	var hashes [][]byte
+	for current := hash; len(current) > 0; {
+		h, err := getHeader(tx, current)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h.Hash)
+		current = h.PrevBlockHash
+	}
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID); if err != nil {
-				panic(err)
-			}
-			// Insert the serialized outputs, with their transaction's ID as the key
-			err = b.Put(key, outs.Serialize())
+	b := tx.Bucket([]byte(blocksBucket))
+	for i := len(hashes) - 1; i >= 0; i-- {
+		blk, err := getBlock(b, hashes[i])
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		err = connectBlock(tx, blk); if err != nil {
+			return err
+		}
+	}
+	return putUTXOTip(tx, hash)
 }
 
-// FindSpendableOutputs runs through the utxo bucket, and checks if there are any UTXO's that are owned by the address requesting them.
+// FindSpendableOutputs looks up the UTXO's that are owned by the address requesting them in the address index, until they add up to amount.
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.DB
 
-	// check the db for outputs that belong to the address
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				// make sure the address owns them
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					// add the amount of coins to accumulated
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
-			}
+	u.forEachOwned(pubKeyHash, func(op Outpoint, entry UTXOEntry) bool {
+		// make sure the address owns them
+		if entry.Output.IsLockedWithKey(pubKeyHash) {
+			// add the amount of coins to accumulated
+			accumulated += entry.Output.Value
+			txID := hex.EncodeToString(op.Txid)
+			unspentOutputs[txID] = append(unspentOutputs[txID], op.Vout)
 		}
-		return nil
-	}); if err != nil {
-		panic(err)
-	}
+		return accumulated < amount
+	})
 
 	return accumulated, unspentOutputs
 }
 
 // FindUTXO is a method of UTXOSet, not to be confused with the Blockchain method of the same name. This FindUTXO is used to get the balance of an address.
-// FindSpendableOutputs finds the first x amount of outputs that contain enough coins to satisfy the transfer. This function checks through every output.
+// FindSpendableOutputs finds the first x amount of outputs that contain enough coins to satisfy the transfer. This function returns every output
+// the address owns.
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
-	db := *u.Blockchain.DB
 
-	err := db.View(func(tx *bolt.Tx) error {
+	u.forEachOwned(pubKeyHash, func(op Outpoint, entry UTXOEntry) bool {
+		if entry.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, entry.Output)
+		}
+		return true
+	})
+
+	return UTXOs
+}
+
+// forEachOwned calls fn with every unspent output locked to pubKeyHash, until fn returns false. The outputs are found through the address index,
+// so only the address's own outputs are read.
+func (u UTXOSet) forEachOwned(pubKeyHash []byte, fn func(op Outpoint, entry UTXOEntry) bool) {
+	prefix := addrIndexPrefix(pubKeyHash)
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+		c := tx.Bucket([]byte(addrIndexBucket)).Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			op := outpointFromKey(k[len(prefix):])
+			entryBytes := b.Get(op.Key())
+			if entryBytes == nil {
+				return fmt.Errorf("address index points at output %x:%d, which isn't in the UTXO set", op.Txid, op.Vout)
+			}
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+			entry, err := DeserializeUTXOEntry(entryBytes); if err != nil {
+				return err
+			}
+			if !fn(op, entry) {
+				return nil
 			}
 		}
 		return nil
 	}); if err != nil {
 		panic(err)
 	}
-
-	return UTXOs
 }
 
 // Update is used to update the utxoBucket when there are newly referenced or created outputs. Pretty much every time a transaction is made, and also when a new block
-// is added to the chain. Find the outputs on a TX that an input references, and then if they don't match the index in the input, that output is free.
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.DB
+// is added to the chain. Every output an input references is deleted, and every output the block's transactions create is added, along with
+// their keys in the address index.
+// Everything that's deleted is kept in an undo record for the block, so that Disconnect can undo it. If one of the outputs isn't in the set,
+// an error is returned and nothing is changed.
+func (u UTXOSet) Update(block *Block) error {
+	return u.Blockchain.DB.Update(func(dbTx *bolt.Tx) error {
+		return connectBlock(dbTx, block)
+	})
+}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+// connectBlock does what Update does, within a db transaction. It's used by Update, and wherever connecting a block has to be done in the
+// same db transaction as storing it.
+func connectBlock(dbTx *bolt.Tx, block *Block) error {
+	b := dbTx.Bucket([]byte(utxoBucket))
+	undo := BlockUndo{Txs: make([]TxUndo, len(block.Transactions))}
+
+	for txIdx, tx := range block.Transactions {
+		txUndo := &undo.Txs[txIdx]
+
+		// Skip coinbase transactions, as we don't care about their inputs.
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				op := Outpoint{Txid: vin.Txid, Vout: vin.Vout}
+				if !op.Valid() {
+					return fmt.Errorf("transaction %x spends output %x:%d, which can't exist", tx.ID, vin.Txid, vin.Vout)
+				}
+				entryBytes := b.Get(op.Key())
+				if entryBytes == nil {
+					return fmt.Errorf("transaction %x spends output %x:%d, which isn't in the UTXO set", tx.ID, vin.Txid, vin.Vout)
+				}
+				entry, err := DeserializeUTXOEntry(entryBytes); if err != nil {
+					return err
+				}
 
-		for _, tx := range block.Transactions {
-			// Skip coinbase transactions, as we don't care about their inputs.
-			if !tx.IsCoinbase() {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					// Get every output stored on the transaction that this input references. Don't worry, as we will make sure
-					// to only store the ones that don't have the same index as vin.Vout.
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					// make sure to only store TX not referenced by inputs
-					// TODO: um what if for example, the output on a transaction is referenced by a different input. It was just added to the bucket
-					// since it isn't referenced by this input. Can it happen that even though it isn't referenced by this input, it still is referenced
-					// elsewhere? Maybe I'm missing something. Needs to be checked out.
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					// If there are no open outputs anymore on that transaction, delete the transaction.
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid); if err != nil {
-							fmt.Println("error deleting txid", vin.Txid, err)
-						}
-					// Otherwise, insert that output into the DB.
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize()); if err != nil {
-							fmt.Println("error inserting output", err)
-						}
-					}
+				txUndo.Spent = append(txUndo.Spent, SpentOutput{Txid: vin.Txid, Vout: vin.Vout, Entry: entry})
+				err = deleteUTXO(dbTx, op, entry); if err != nil {
+					return err
 				}
 			}
-			// Now is the part where we insert all the outputs on a new transaction. Applies to coinbase too, since we care about coinbase outputs.
-			newOutputs := TXOutputs{}
-			// for every output, store it in our struct
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		}
+
+		// Now is the part where we insert all the outputs on a new transaction. Applies to coinbase too, since we care about coinbase outputs.
+		for outIdx, out := range tx.Vout {
+			entry := UTXOEntry{Output: out, Height: block.Height, Coinbase: tx.IsCoinbase()}
+			err := putUTXO(dbTx, Outpoint{Txid: tx.ID, Vout: outIdx}, entry); if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := indexBlockTransactions(dbTx, block); if err != nil {
+		return err
+	}
+
+	ub, err := dbTx.CreateBucketIfNotExists([]byte(undoBucket)); if err != nil {
+		return err
+	}
+	err = ub.Put(block.Hash, undo.Serialize()); if err != nil {
+		return err
+	}
+	return putUTXOTip(dbTx, block.Hash)
+}
+
+// Disconnect undoes Update for a block, which must be the last block connected to the UTXO set. The outputs its transactions created are removed,
+// and the outputs they spent are put back, using the block's undo record. The undo record is deleted once it's used. Blocks that were connected
+// before undo records were kept don't have one, and an error is returned without touching the set.
+func (u UTXOSet) Disconnect(block *Block) error {
+	return u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		return disconnectBlock(tx, block)
+	})
+}
+
+// disconnectBlock does what Disconnect does, within a db transaction.
+func disconnectBlock(tx *bolt.Tx, block *Block) error {
+	ub := tx.Bucket([]byte(undoBucket))
+	if ub == nil || ub.Get(block.Hash) == nil {
+		return fmt.Errorf("%w %x", errNoUndoRecord, block.Hash)
+	}
+
+	undo, err := DeserializeBlockUndo(ub.Get(block.Hash)); if err != nil {
+		return err
+	}
+	if len(undo.Txs) != len(block.Transactions) {
+		return fmt.Errorf("undo record for block %x doesn't match its transactions", block.Hash)
+	}
+
+	// undo the transactions in the opposite order they were connected in, so that a transaction that spent an output of an earlier
+	// transaction in the same block puts it back before that earlier transaction is removed.
+	for txIdx := len(block.Transactions) - 1; txIdx >= 0; txIdx-- {
+		blockTx := block.Transactions[txIdx]
+
+		for outIdx, out := range blockTx.Vout {
+			err = deleteUTXO(tx, Outpoint{Txid: blockTx.ID, Vout: outIdx}, UTXOEntry{Output: out}); if err != nil {
+				return err
 			}
-			// Insert out slice of outputs into the db.
-			err := b.Put(tx.ID, newOutputs.Serialize()); if err != nil {
-				fmt.Println("error putting in serialized txID", tx.ID, err)
+		}
+
+		for _, spent := range undo.Txs[txIdx].Spent {
+			err = putUTXO(tx, Outpoint{Txid: spent.Txid, Vout: spent.Vout}, spent.Entry); if err != nil {
+				return err
 			}
 		}
-		return nil
+	}
+
+	err = unindexBlockTransactions(tx, block); if err != nil {
+		return err
+	}
+	err = ub.Delete(block.Hash); if err != nil {
+		return err
+	}
+	return putUTXOTip(tx, block.PrevBlockHash)
+}
+
+// FindOutput looks up a single unspent output by the ID of its transaction and its index. It returns false if the output is spent or doesn't exist.
+func (u UTXOSet) FindOutput(txID []byte, vout int) (TXOutput, bool) {
+	entry, found := u.FindEntry(txID, vout)
+	return entry.Output, found
+}
+
+// FindEntry looks up a single unspent output like FindOutput does, along with the height of its block, and whether it's a coinbase output.
+func (u UTXOSet) FindEntry(txID []byte, vout int) (UTXOEntry, bool) {
+	var (
+		entry UTXOEntry
+		found bool
+	)
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, found, err = findEntry(tx, txID, vout)
+		return err
 	}); if err != nil {
 		panic(err)
 	}
-}
\ No newline at end of file
+
+	return entry, found
+}
+
+// findEntry does what FindEntry does, within a db transaction.
+func findEntry(tx *bolt.Tx, txID []byte, vout int) (UTXOEntry, bool, error) {
+	op := Outpoint{Txid: txID, Vout: vout}
+	if !op.Valid() {
+		return UTXOEntry{}, false, nil
+	}
+
+	entryBytes := tx.Bucket([]byte(utxoBucket)).Get(op.Key())
+	if entryBytes == nil {
+		return UTXOEntry{}, false, nil
+	}
+
+	entry, err := DeserializeUTXOEntry(entryBytes)
+	if err != nil {
+		return UTXOEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// SignTransaction signs a transaction like Blockchain.SignTransaction does, but takes the outputs its inputs spend straight from the UTXO set.
+// It returns an error if one of them isn't unspent.
+func (u UTXOSet) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevOuts, err := u.prevOutputs(tx); if err != nil {
+		return err
+	}
+	return tx.SignOutputs(privKey, prevOuts)
+}
+
+// VerifyTransaction verifies a transaction's signatures like Blockchain.VerifyTransaction does, but takes the outputs its inputs spend straight
+// from the UTXO set. A transaction that spends an output that isn't unspent is invalid.
+func (u UTXOSet) VerifyTransaction(tx *Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+
+	prevOuts, err := u.prevOutputs(tx); if err != nil {
+		return false
+	}
+	return tx.VerifyOutputs(prevOuts)
+}
+
+// prevOutputs looks up the outputs in the UTXO set that tx's inputs spend, keyed the way SignOutputs and VerifyOutputs expect.
+func (u UTXOSet) prevOutputs(tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
+
+	for _, vin := range tx.Vin {
+		out, ok := u.FindOutput(vin.Txid, vin.Vout); if !ok {
+			return nil, fmt.Errorf("output %x:%d isn't in the UTXO set", vin.Txid, vin.Vout)
+		}
+		prevOuts[outpointKey(vin.Txid, vin.Vout)] = out
+	}
+	return prevOuts, nil
+}
+
+// hasUTXOSet checks whether the UTXO set and its address index are stored in the current format. Chains that were created before them have to
+// be reindexed.
+func hasUTXOSet(tx *bolt.Tx) bool {
+	return tx.Bucket([]byte(utxoBucket)) != nil && tx.Bucket([]byte(addrIndexBucket)) != nil
+}
+
+// putUTXOTip records that the UTXO set is at the block hash.
+func putUTXOTip(tx *bolt.Tx, hash []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(utxoTipBucket)); if err != nil {
+		return err
+	}
+	return b.Put([]byte("l"), hash)
+}
+
+// utxoSetAtTip checks whether the UTXO set is at the tail of the chain. Sets that were built before utxoTipBucket was kept aren't, and have
+// to be reindexed once.
+func utxoSetAtTip(tx *bolt.Tx) bool {
+	b := tx.Bucket([]byte(utxoTipBucket))
+	if b == nil {
+		return false
+	}
+	return bytes.Equal(b.Get([]byte("l")), tx.Bucket([]byte(blocksBucket)).Get([]byte("l")))
+}
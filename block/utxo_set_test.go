@@ -0,0 +1,156 @@
+package block
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// dumpBuckets returns the contents of the named buckets, so that the state of the db can be compared before and after a change.
+func (c *testChain) dumpBuckets(t *testing.T, names ...string) map[string]map[string]string {
+	dump := make(map[string]map[string]string)
+
+	err := c.bc.DB.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			dump[name] = make(map[string]string)
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				dump[name][string(k)] = string(v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func TestUpdateDisconnect(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	receiver := NewWallet()
+	u := UTXOSet{Blockchain: c.bc}
+	before := c.dumpBuckets(t, utxoBucket, addrIndexBucket, utxoTipBucket)
+
+	// the second transaction spends an output of the first one, so they have to be undone in the opposite order
+	first := c.spend(t, c.owner.PrivateKey, []TXInput{c.genesisInput(t, c.owner.PublicKey)},
+		NewTXOutput(4, string(receiver.GetAddress())), NewTXOutput(BlockSubsidy(0)-4, string(c.owner.GetAddress())))
+	second := &Transaction{
+		Vin:  []TXInput{{Txid: first.ID, Vout: 1, PubKey: c.owner.PublicKey}},
+		Vout: []TXOutput{*NewTXOutput(BlockSubsidy(0)-4, string(receiver.GetAddress()))},
+	}
+	err := second.SignOutputs(c.owner.PrivateKey, map[string]TXOutput{outpointKey(first.ID, 1): first.Vout[1]}); if err != nil {
+		t.Fatal(err)
+	}
+	second.ID = second.Hash()
+
+	blk := c.mine(t, []*Transaction{first, second}, 0, nil)
+	err = u.Update(blk); if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.balance(receiver); got != BlockSubsidy(0) {
+		t.Errorf("receiver's balance after Update is %d, want %d", got, BlockSubsidy(0))
+	}
+	if got := c.balance(c.owner); got != BlockSubsidy(1) {
+		t.Errorf("owner's balance after Update is %d, want %d", got, BlockSubsidy(1))
+	}
+
+	err = u.Disconnect(blk); if err != nil {
+		t.Fatal(err)
+	}
+	if after := c.dumpBuckets(t, utxoBucket, addrIndexBucket, utxoTipBucket); !reflect.DeepEqual(before, after) {
+		t.Error("Disconnect didn't restore the UTXO set and the address index")
+	}
+	if got := c.balance(receiver); got != 0 {
+		t.Errorf("receiver's balance after Disconnect is %d, want 0", got)
+	}
+	if err := u.Disconnect(blk); err == nil {
+		t.Error("Disconnect undid a block twice")
+	}
+}
+
+func TestReindexKeepsUndoRecords(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	before := c.dumpBuckets(t, utxoBucket, addrIndexBucket)
+	blk := c.mine(t, nil, 0, nil)
+	err := c.bc.AppendBlock(blk); if err != nil {
+		t.Fatal(err)
+	}
+
+	u := UTXOSet{Blockchain: c.bc}
+	connected := c.dumpBuckets(t, utxoBucket, addrIndexBucket, undoBucket)
+	u.Reindex()
+	if reindexed := c.dumpBuckets(t, utxoBucket, addrIndexBucket, undoBucket); !reflect.DeepEqual(connected, reindexed) {
+		t.Error("Reindex didn't rebuild the same UTXO set, address index and undo records as connecting the blocks did")
+	}
+
+	err = u.Disconnect(blk); if err != nil {
+		t.Fatalf("can't disconnect a block after a reindex: %v", err)
+	}
+	if after := c.dumpBuckets(t, utxoBucket, addrIndexBucket); !reflect.DeepEqual(before, after) {
+		t.Error("Disconnect didn't restore the UTXO set and the address index")
+	}
+}
+
+func TestOwnerIndexBalances(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	receiver := NewWallet()
+	u := UTXOSet{Blockchain: c.bc}
+	genesisIn := c.genesisInput(t, c.owner.PublicKey)
+	genesisOutputs := map[string][]int{hex.EncodeToString(genesisIn.Txid): {0}}
+
+	spend := c.spend(t, c.owner.PrivateKey, []TXInput{genesisIn},
+		NewTXOutput(4, string(receiver.GetAddress())), NewTXOutput(BlockSubsidy(0)-4, string(c.owner.GetAddress())))
+	blk := c.mine(t, []*Transaction{spend}, 0, nil)
+	err := c.bc.AppendBlock(blk); if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		owner   *Wallet
+		balance int
+		outputs map[string][]int
+	}{
+		{"receiver after the spend", receiver, 4, map[string][]int{hex.EncodeToString(spend.ID): {0}}},
+		{"owner after the spend", c.owner, BlockSubsidy(0) - 4 + BlockSubsidy(1), map[string][]int{
+			hex.EncodeToString(spend.ID):                {1},
+			hex.EncodeToString(blk.Transactions[0].ID): {0},
+		}},
+	}
+	for _, tt := range tests {
+		balance, outputs := u.FindSpendableOutputs(HashPubKey(tt.owner.PublicKey), tt.balance+1)
+		if balance != tt.balance || !reflect.DeepEqual(outputs, tt.outputs) {
+			t.Errorf("%s: found %d in %v, want %d in %v", tt.name, balance, outputs, tt.balance, tt.outputs)
+		}
+		if got := c.balance(tt.owner); got != tt.balance {
+			t.Errorf("%s: balance is %d, want %d", tt.name, got, tt.balance)
+		}
+	}
+
+	err = u.Disconnect(blk); if err != nil {
+		t.Fatal(err)
+	}
+	if balance, outputs := u.FindSpendableOutputs(HashPubKey(receiver.PublicKey), 1); balance != 0 || len(outputs) != 0 {
+		t.Errorf("receiver after the disconnect: found %d in %v, want nothing", balance, outputs)
+	}
+	balance, outputs := u.FindSpendableOutputs(HashPubKey(c.owner.PublicKey), BlockSubsidy(0)+1)
+	if balance != BlockSubsidy(0) || !reflect.DeepEqual(outputs, genesisOutputs) {
+		t.Errorf("owner after the disconnect: found %d in %v, want the genesis coinbase's %d in %v", balance, outputs, BlockSubsidy(0), genesisOutputs)
+	}
+}
@@ -0,0 +1,339 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every block that comes from another node is validated before it's connected to the main chain. Some checks only need the block itself (the
+// proof of work, the merkle root, the coinbase), some need its parent's header (the height, the target, the timestamp), and some need the UTXO
+// set the block is connected on top of (the inputs, the signatures, the reward). The last ones can only be done once the block is about to become
+// part of the main chain, so a block on a side branch is only fully validated when its branch takes over.
+
+const (
+	// invalidBlocksBucket stores the hashes of blocks that failed validation, so that neither they nor their children are downloaded again.
+	invalidBlocksBucket = "invalidBlocksBucket"
+	// maxFutureBlockTime is how far ahead of our clock a block's timestamp is allowed to be, in seconds.
+	maxFutureBlockTime = 2 * 60 * 60
+	// medianTimeBlocks is how many blocks the median time past is worked out over. A block's timestamp has to be after it.
+	medianTimeBlocks = 11
+)
+
+var (
+	errNoTransactions    = errors.New("block has no transactions")
+	errBadTxID           = errors.New("transaction's ID doesn't match its hash")
+	errBadCoinbase       = errors.New("block's first transaction, and only its first transaction, has to be a coinbase")
+	errBadCoinbaseHeight = errors.New("coinbase doesn't commit to the block's height")
+	errCoinbaseTooLong   = errors.New("coinbase data is too long")
+	errDuplicateTx       = errors.New("block contains the same transaction twice")
+	errBadMerkleRoot     = errors.New("block's merkle root doesn't match its transactions")
+	errBadTxOutputs      = errors.New("transaction has no inputs, no outputs, or outputs with a negative or too large value")
+	errBadTxInput        = errors.New("transaction has an input that spends an output index out of range")
+	errDuplicateInput    = errors.New("transaction spends the same output twice")
+	errTimeTooNew        = errors.New("block's timestamp is too far in the future")
+	errTimeTooOld        = errors.New("block's timestamp isn't after the median time of the blocks before it")
+	errBadReward         = errors.New("coinbase pays more than the block subsidy plus fees")
+	errBlockDoubleSpend  = errors.New("block spends the same output twice")
+	errBlockOverwrite    = errors.New("block contains a transaction whose outputs are already unspent")
+	errBlockMissingInput = errors.New("block spends an output that isn't in the UTXO set")
+	errBlockWrongOwner   = errors.New("block contains a transaction that spends an output locked to another key")
+	errBlockBadSignature = errors.New("block contains a transaction with an invalid signature")
+	errBlockNegativeFee  = errors.New("block contains a transaction whose outputs are worth more than its inputs")
+	errNotOnTip          = errors.New("block doesn't build on the tail of the chain")
+	errInvalidBlock      = errors.New("block, or one of its ancestors, failed validation")
+)
+
+// ValidateBlock runs every consensus check on a block that builds on the tail of the chain: its proof of work against the target it should have,
+// its parent and height, its merkle root, its timestamp, its coinbase and reward, and every input and signature of its transactions against
+// the UTXO set. It doesn't change anything.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	err := checkBlockSanity(block); if err != nil {
+		return err
+	}
+
+	return bc.DB.View(func(tx *bolt.Tx) error {
+		return checkBlockOnTip(tx, block)
+	})
+}
+
+// checkBlockOnTip runs the checks of ValidateBlock that need the chain, within a db transaction: the block has to build on the tail, its
+// header has to follow from its parent's, and its transactions have to be valid against the UTXO set.
+func checkBlockOnTip(tx *bolt.Tx, block *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))) {
+		return errNotOnTip
+	}
+
+	parent, err := getHeader(tx, block.PrevBlockHash)
+	if err != nil {
+		return errUnknownParent
+	}
+	err = checkHeaderContext(tx, block.Header(), parent); if err != nil {
+		return err
+	}
+
+	return checkBlockTransactions(tx, block)
+}
+
+// checkBlockSanity runs the checks that only need the block itself.
+func checkBlockSanity(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return errNoTransactions
+	}
+
+	header := block.Header()
+	if !header.ValidatePoW() {
+		return errBadPoW
+	}
+	if block.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return errTimeTooNew
+	}
+
+	seen := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return errBadCoinbase
+		}
+		err := checkTransactionSanity(tx); if err != nil {
+			return err
+		}
+
+		id := hex.EncodeToString(tx.ID)
+		if seen[id] {
+			return errDuplicateTx
+		}
+		seen[id] = true
+	}
+
+	coinbase := block.Transactions[0]
+	if len(coinbase.Vin[0].PubKey) > maxCoinbaseDataLen {
+		return errCoinbaseTooLong
+	}
+	if height, ok := coinbase.CoinbaseHeight(); !ok || height != block.Height {
+		return errBadCoinbaseHeight
+	}
+
+	// the IDs were checked above, so the merkle root covers every transaction's contents
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return errBadMerkleRoot
+	}
+	return nil
+}
+
+// checkTransactionSanity runs the checks that only need the transaction itself: its ID has to be its hash, it has to have inputs and
+// outputs, its inputs have to spend different outputs, at indexes that fit in an outpoint's key, and its outputs can't be negative or add up to
+// more than maxSupply. Without that last check, outputs big enough to overflow
+// would add up to less than the inputs, and the transaction would pay a fee while creating coins out of thin air.
+func checkTransactionSanity(tx *Transaction) error {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return errBadTxID
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return errBadTxOutputs
+	}
+	if !tx.IsCoinbase() {
+		// an output listed twice would have its value counted twice
+		seen := make(map[string]bool)
+		for _, vin := range tx.Vin {
+			if !(Outpoint{Txid: vin.Txid, Vout: vin.Vout}).Valid() {
+				return errBadTxInput
+			}
+			key := outpointKey(vin.Txid, vin.Vout)
+			if seen[key] {
+				return errDuplicateInput
+			}
+			seen[key] = true
+		}
+	}
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > maxSupply {
+			return errBadTxOutputs
+		}
+		total += out.Value
+		if total > maxSupply {
+			return errBadTxOutputs
+		}
+	}
+	return nil
+}
+
+// checkHeaderContext runs the checks that need the header's parent: the height has to follow the parent's, the target has to be the one
+// the chain calls for, and the timestamp has to be after the median time past.
+func checkHeaderContext(tx *bolt.Tx, h BlockHeader, parent BlockHeader) error {
+	if h.Height != parent.Height+1 {
+		return errBadHeight
+	}
+
+	bits, err := nextBits(tx, parent)
+	if err != nil {
+		return err
+	}
+	if h.Bits != bits {
+		return errBadBits
+	}
+
+	mtp, err := medianTimePast(tx, parent)
+	if err != nil {
+		return err
+	}
+	if h.Timestamp <= mtp {
+		return errTimeTooOld
+	}
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the last medianTimeBlocks blocks, ending at h. A miner can't go far back in time with its
+// timestamps, since the median only moves forward, but a few miners with a bad clock can't stop the chain either.
+func medianTimePast(tx *bolt.Tx, h BlockHeader) (int64, error) {
+	var timestamps []int64
+
+	for {
+		timestamps = append(timestamps, h.Timestamp)
+		if len(timestamps) == medianTimeBlocks || len(h.PrevBlockHash) == 0 {
+			break
+		}
+
+		var err error
+		h, err = getHeader(tx, h.PrevBlockHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// MinTimestamp returns the earliest timestamp a block built on top of prevHash can have.
+func (bc *Blockchain) MinTimestamp(prevHash []byte) (int64, error) {
+	var mtp int64
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		parent, err := getHeader(tx, prevHash)
+		if err != nil {
+			return err
+		}
+		mtp, err = medianTimePast(tx, parent)
+		return err
+	})
+	return mtp + 1, err
+}
+
+// checkBlockTransactions checks a block's transactions against the UTXO set it's about to be connected on top of. No transaction can already
+// have unspent outputs in the set. Every input has to spend an output that's either unspent in the set, or created by an earlier transaction in
+// the same block, and no output can be spent twice. Every input has to be signed by the key its output is locked to, every signature has to be
+// valid, no transaction can create more than it spends, and the coinbase can't pay more than the block's subsidy plus the fees.
+func checkBlockTransactions(tx *bolt.Tx, block *Block) error {
+	created := make(map[string]*Transaction) // created holds the block's transactions that came before the one being checked
+	spent := make(map[string]bool)
+	fees := 0
+
+	// a transaction that's already in the UTXO set would overwrite its own unspent outputs
+	for _, blockTx := range block.Transactions {
+		for outIdx := range blockTx.Vout {
+			_, found, err := findEntry(tx, blockTx.ID, outIdx); if err != nil {
+				return err
+			}
+			if found {
+				return errBlockOverwrite
+			}
+		}
+	}
+
+	for _, blockTx := range block.Transactions[1:] {
+		prevOuts := make(map[string]TXOutput)
+		inputs := 0
+
+		for _, vin := range blockTx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spent[key] {
+				return errBlockDoubleSpend
+			}
+			spent[key] = true
+
+			out, ok, err := findBlockOutput(tx, created, vin.Txid, vin.Vout); if err != nil {
+				return err
+			}
+			if !ok {
+				return errBlockMissingInput
+			}
+			if !vin.UsesKey(out.PubKeyHash) {
+				return errBlockWrongOwner
+			}
+			inputs += out.Value
+			prevOuts[key] = out
+		}
+
+		outputs := 0
+		for _, out := range blockTx.Vout {
+			outputs += out.Value
+		}
+		if outputs > inputs {
+			return errBlockNegativeFee
+		}
+		fees += inputs - outputs
+
+		if !blockTx.VerifyOutputs(prevOuts) {
+			return errBlockBadSignature
+		}
+		created[hex.EncodeToString(blockTx.ID)] = blockTx
+	}
+
+	reward := 0
+	for _, out := range block.Transactions[0].Vout {
+		reward += out.Value
+	}
+	if reward > BlockSubsidy(block.Height)+fees {
+		return errBadReward
+	}
+	return nil
+}
+
+// findBlockOutput looks up an output first among the transactions created earlier in the block, and then in the UTXO set.
+func findBlockOutput(tx *bolt.Tx, created map[string]*Transaction, txID []byte, vout int) (TXOutput, bool, error) {
+	if blockTx, ok := created[hex.EncodeToString(txID)]; ok {
+		if vout < 0 || vout >= len(blockTx.Vout) {
+			return TXOutput{}, false, nil
+		}
+		return blockTx.Vout[vout], true, nil
+	}
+
+	entry, found, err := findEntry(tx, txID, vout)
+	return entry.Output, found, err
+}
+
+// markInvalid remembers that a block failed validation. The best header goes back to the tail of the chain, since the headers past the
+// invalid block lead nowhere.
+func (bc *Blockchain) markInvalid(hash []byte) {
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(invalidBlocksBucket))
+		if err != nil {
+			return err
+		}
+		err = b.Put(hash, []byte{1})
+		if err != nil {
+			return err
+		}
+
+		hb, err := tx.CreateBucketIfNotExists([]byte(headersBucket))
+		if err != nil {
+			return err
+		}
+		tip := append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return hb.Put([]byte("l"), tip)
+	}); if err != nil {
+		fmt.Println("error marking block as invalid", err)
+	}
+}
+
+// isInvalid checks whether a block failed validation before.
+func isInvalid(tx *bolt.Tx, hash []byte) bool {
+	b := tx.Bucket([]byte(invalidBlocksBucket))
+	return b != nil && b.Get(hash) != nil
+}
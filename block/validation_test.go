@@ -0,0 +1,256 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// testChain is a fresh chain in a temporary directory, whose genesis coinbase pays owner.
+type testChain struct {
+	bc    *Blockchain
+	owner *Wallet
+	dir   string
+}
+
+func newTestChain(t *testing.T) *testChain {
+	dir, err := ioutil.TempDir("", "acoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := NewWallet()
+	bc := CreateBlockchain(string(owner.GetAddress()), dir)
+	UTXOSet{Blockchain: bc}.Reindex()
+
+	return &testChain{bc: bc, owner: owner, dir: dir}
+}
+
+func (c *testChain) close() {
+	c.bc.DB.Close()
+	os.RemoveAll(c.dir)
+}
+
+// genesisInput returns the input that spends the genesis coinbase's output with pubKey.
+func (c *testChain) genesisInput(t *testing.T, pubKey []byte) TXInput {
+	genesis, err := c.bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TXInput{Txid: genesis.Transactions[0].ID, Vout: 0, PubKey: pubKey}
+}
+
+// spend builds a transaction out of inputs and outputs, signed with key.
+func (c *testChain) spend(t *testing.T, key ecdsa.PrivateKey, inputs []TXInput, outputs ...*TXOutput) *Transaction {
+	tx := &Transaction{Vin: inputs}
+	for _, out := range outputs {
+		tx.Vout = append(tx.Vout, *out)
+	}
+
+	err := UTXOSet{Blockchain: c.bc}.SignTransaction(tx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+// mine mines a block on top of the tail out of txs, with a coinbase that claims fees. tamper, if it isn't nil, can change the block before
+// it's mined.
+func (c *testChain) mine(t *testing.T, txs []*Transaction, fees int, tamper func(b *Block)) *Block {
+	lastHash, _ := c.bc.lastBlock()
+	parent, err := c.bc.GetBlock(lastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.mineOn(t, parent, "", txs, fees, tamper)
+}
+
+// mineOn mines a block like mine does, but on top of parent, which doesn't have to be the tail. Blocks mined on different branches at the
+// same height need a different coinbase data, or their coinbases would have the same ID.
+func (c *testChain) mineOn(t *testing.T, parent *Block, data string, txs []*Transaction, fees int, tamper func(b *Block)) *Block {
+	cbTx := NewCoinbaseTX(string(c.owner.GetAddress()), data, parent.Height+1, fees)
+
+	blk, err := c.bc.blockTemplate(append([]*Transaction{cbTx}, txs...), parent.Hash, parent.Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(blk)
+	}
+	err = NewMiner(1, nil).Mine(context.Background(), blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func (c *testChain) balance(w *Wallet) int {
+	total := 0
+	for _, out := range (UTXOSet{Blockchain: c.bc}).FindUTXO(HashPubKey(w.PublicKey)) {
+		total += out.Value
+	}
+	return total
+}
+
+func TestRejectWrongOwnerSpend(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	thief := NewWallet()
+	u := UTXOSet{Blockchain: c.bc}
+	tx := c.spend(t, thief.PrivateKey, []TXInput{c.genesisInput(t, thief.PublicKey)}, NewTXOutput(BlockSubsidy(0), string(thief.GetAddress())))
+
+	if u.VerifyTransaction(tx) {
+		t.Error("VerifyTransaction accepted a spend signed by a key the output isn't locked to")
+	}
+	if err := NewMempool(0).Add(*tx, u); err != errTxWrongOwner {
+		t.Errorf("Mempool.Add returned %v, want %v", err, errTxWrongOwner)
+	}
+
+	blk := c.mine(t, []*Transaction{tx}, 0, nil)
+	if err := c.bc.ValidateBlock(blk); err != errBlockWrongOwner {
+		t.Errorf("ValidateBlock returned %v, want %v", err, errBlockWrongOwner)
+	}
+	if _, err := c.bc.AddBlock(blk); err == nil {
+		t.Error("AddBlock accepted a block that spends another key's output")
+	}
+	if got := c.balance(c.owner); got != BlockSubsidy(0) {
+		t.Errorf("owner's balance is %d, want %d", got, BlockSubsidy(0))
+	}
+
+	// the owner can still spend it
+	tx = c.spend(t, c.owner.PrivateKey, []TXInput{c.genesisInput(t, c.owner.PublicKey)}, NewTXOutput(BlockSubsidy(0), string(thief.GetAddress())))
+	blk = c.mine(t, []*Transaction{tx}, 0, nil)
+	if _, err := c.bc.AddBlock(blk); err != nil {
+		t.Errorf("AddBlock rejected a valid spend: %v", err)
+	}
+	if got := c.balance(thief); got != BlockSubsidy(0) {
+		t.Errorf("receiver's balance is %d, want %d", got, BlockSubsidy(0))
+	}
+}
+
+func TestRejectDuplicateInput(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	in := c.genesisInput(t, c.owner.PublicKey)
+	tx := c.spend(t, c.owner.PrivateKey, []TXInput{in, in}, NewTXOutput(2*BlockSubsidy(0), string(c.owner.GetAddress())))
+
+	if err := NewMempool(0).Add(*tx, UTXOSet{Blockchain: c.bc}); err != errDuplicateInput {
+		t.Errorf("Mempool.Add returned %v, want %v", err, errDuplicateInput)
+	}
+
+	blk := c.mine(t, []*Transaction{tx}, 0, nil)
+	if err := c.bc.ValidateBlock(blk); err != errDuplicateInput {
+		t.Errorf("ValidateBlock returned %v, want %v", err, errDuplicateInput)
+	}
+}
+
+func TestRejectCoinbaseOverclaim(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	// there are no transactions, so there are no fees to claim
+	blk := c.mine(t, nil, 1, nil)
+	if err := c.bc.ValidateBlock(blk); err != errBadReward {
+		t.Errorf("ValidateBlock returned %v, want %v", err, errBadReward)
+	}
+}
+
+func TestRejectBadMerkleRoot(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	blk := c.mine(t, nil, 0, func(b *Block) {
+		b.MerkleRoot = make([]byte, len(b.MerkleRoot))
+	})
+	if err := c.bc.ValidateBlock(blk); err != errBadMerkleRoot {
+		t.Errorf("ValidateBlock returned %v, want %v", err, errBadMerkleRoot)
+	}
+	if _, err := c.bc.AddBlock(blk); err != errBadMerkleRoot {
+		t.Errorf("AddBlock returned %v, want %v", err, errBadMerkleRoot)
+	}
+}
+
+func TestRejectOutOfRangeVout(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	// an index one past what fits in 4 bytes would have the same key as output 0
+	past := int64(maxVout) + 1
+	in := c.genesisInput(t, c.owner.PublicKey)
+	in.Vout = int(past)
+	tx := &Transaction{Vin: []TXInput{in}, Vout: []TXOutput{*NewTXOutput(1, string(c.owner.GetAddress()))}}
+	tx.ID = tx.Hash()
+
+	u := UTXOSet{Blockchain: c.bc}
+	if _, ok := u.FindOutput(in.Txid, in.Vout); ok {
+		t.Error("FindOutput found an output past the largest index")
+	}
+	if err := NewMempool(0).Add(*tx, u); err != errBadTxInput {
+		t.Errorf("Mempool.Add returned %v, want %v", err, errBadTxInput)
+	}
+}
+
+func TestRejectInvalidReorgWithoutUndoRecords(t *testing.T) {
+	c := newTestChain(t)
+	defer c.close()
+
+	genesis, err := c.bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := c.mine(t, nil, 0, nil)
+	err = c.bc.AppendBlock(main); if err != nil {
+		t.Fatal(err)
+	}
+
+	// chains from before undo records were kept can't roll back their blocks, and have to rebuild the UTXO set instead
+	err = c.bc.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(undoBucket)).Delete(main.Hash)
+	}); if err != nil {
+		t.Fatal(err)
+	}
+	before := c.dumpBuckets(t, utxoBucket, addrIndexBucket, utxoTipBucket)
+	balance := c.balance(c.owner)
+
+	side := c.mineOn(t, genesis, "side", nil, 0, nil)
+	if change, err := c.bc.AddBlock(side); change != nil || err != nil {
+		t.Fatalf("AddBlock returned %v, %v for a block on a side branch", change, err)
+	}
+	// the side branch takes over with this block, but its coinbase claims more than it's owed
+	overclaim := c.mineOn(t, side, "side", nil, 1000, nil)
+	if _, err := c.bc.AddBlock(overclaim); err != errBadReward {
+		t.Errorf("AddBlock returned %v, want %v", err, errBadReward)
+	}
+
+	if !bytes.Equal(c.bc.TipHash(), main.Hash) {
+		t.Error("the tail moved to an invalid branch")
+	}
+	if got := c.balance(c.owner); got != balance {
+		t.Errorf("owner's balance is %d, want %d", got, balance)
+	}
+	if after := c.dumpBuckets(t, utxoBucket, addrIndexBucket, utxoTipBucket); !reflect.DeepEqual(before, after) {
+		t.Error("the UTXO set changed after an invalid reorg")
+	}
+
+	// a valid branch still takes over
+	other := c.mineOn(t, genesis, "other", nil, 0, nil)
+	if _, err := c.bc.AddBlock(other); err != nil {
+		t.Fatal(err)
+	}
+	next := c.mineOn(t, other, "other", nil, 0, nil)
+	if change, err := c.bc.AddBlock(next); change == nil || err != nil {
+		t.Fatalf("AddBlock returned %v, %v for a block that makes its branch the heaviest", change, err)
+	}
+	if want := BlockSubsidy(0) + BlockSubsidy(1) + BlockSubsidy(2); c.balance(c.owner) != want {
+		t.Errorf("owner's balance is %d, want %d", c.balance(c.owner), want)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
 	"fmt"
+	"math/big"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -25,6 +27,45 @@ func NewWallet() *Wallet {
 	}
 }
 
+// walletData is how a wallet is stored in wallet.dat. The elliptic curve a private key uses can't be gob encoded, so only the private number D and
+// the public key are stored. The rest of the private key is rebuilt from D when the wallet is loaded.
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+// GobEncode encodes a wallet so it can be saved to wallet.dat.
+func (w Wallet) GobEncode() ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(walletData{
+		D:         w.PrivateKey.D.Bytes(),
+		PublicKey: w.PublicKey,
+	})
+	return buff.Bytes(), err
+}
+
+// GobDecode decodes a wallet loaded from wallet.dat, and rebuilds its private key.
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd)
+	if err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(wd.D)
+	x, y := curve.ScalarBaseMult(wd.D)
+
+	w.PrivateKey = ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         d,
+	}
+	w.PublicKey = wd.PublicKey
+	return nil
+}
+
 // NewKeyPair is responsible for getting a public and private key pair for a wallet upon its creation. If first creates a private key based on a elliptic.P256,
 // which is any random number between 10^77. The public key is the x,y coordinates of the private key. Still unclear exactly what that means, but its a
 // private-key specific public-key.
@@ -35,7 +76,7 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 		fmt.Println("error generating keypair", err)
 		panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubKey := concatPadded(private.PublicKey.X, private.PublicKey.Y, keyPartLength)
 	return *private, pubKey
 }
 
@@ -73,8 +114,15 @@ func checksum(payload []byte) []byte {
 	return secondHash[:addressChecksumLen]
 }
 
+// ValidateAddress checks that an address decodes properly, and that its checksum matches the version and public key hash.
 func ValidateAddress(address string) bool {
+	if address == "" {
+		return false
+	}
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= walletChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-walletChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-walletChecksumLen]
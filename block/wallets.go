@@ -2,23 +2,25 @@ package block
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 // Wallets is an instance of multiple Wallet('s). More specifically it is a map of a wallets address to a Wallet struct.
 // i.e : [197QdQzchU4aMF3pTryySADwCsSC6cpj4A:[*Wallet]]
 type Wallets struct {
 	Wallets map[string]*Wallet
+	file    string // file is the path of the wallet.dat file the wallets are loaded from and saved to
 }
 
-// NewWallets loads in all the wallets stored in the wallet.dat file
-func NewWallets() (*Wallets, error) {
+// NewWallets loads in all the wallets stored in the wallet.dat file within dataDir
+func NewWallets(dataDir string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.file = walletPath(dataDir)
 
 	err := wallets.LoadFromFile()
 
@@ -29,16 +31,15 @@ func NewWallets() (*Wallets, error) {
 func (ws *Wallets) LoadFromFile() error {
 	var wallets Wallets
 
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(ws.file); os.IsNotExist(err) {
 		return err
 	}
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(ws.file)
 	if err != nil {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
@@ -54,13 +55,16 @@ func (ws *Wallets) LoadFromFile() error {
 func (ws Wallets) SaveToFile() {
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
 		fmt.Println("error saving wallets to file", err)
 	}
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.MkdirAll(filepath.Dir(ws.file), 0700)
+	if err != nil {
+		fmt.Println("error creating data directory", err)
+	}
+	err = ioutil.WriteFile(ws.file, content.Bytes(), 0644)
 	if err != nil {
 		fmt.Println("error writing wallets to file", err)
 	}
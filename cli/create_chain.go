@@ -4,8 +4,8 @@ import (
 	"github.com/chezky/acoin/block"
 )
 
-func (cli *CLI) createChain(address string) {
-	bc := block.CreateBlockchain(address)
+func (cli *CLI) createChain(address, dataDir string) {
+	bc := block.CreateBlockchain(address, dataDir)
 	defer bc.DB.Close()
 
 	UTXOSet := block.UTXOSet{Blockchain: bc}
@@ -5,8 +5,8 @@ import (
 	"github.com/chezky/acoin/block"
 )
 
-func (cli *CLI) createWallet() {
-	wallets, err := block.NewWallets()
+func (cli *CLI) createWallet(dataDir string) {
+	wallets, err := block.NewWallets(dataDir)
 	if err != nil {
 		fmt.Println("error creating wallet", err)
 		//os.Exit(1)
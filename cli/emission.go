@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/chezky/acoin/block"
+)
+
+// emission shows where the chain is in the emission schedule: the subsidy the next block pays, how many coins were issued so far, and every era
+// of the schedule.
+func (cli *CLI) emission(dataDir string) {
+	bc := block.NewBlockChain(dataDir)
+	defer bc.DB.Close()
+
+	height := bc.GetBestHeight()
+	issued := block.TotalIssued(height)
+	maxSupply := block.MaxSupply()
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Current subsidy: %d\n", block.BlockSubsidy(height+1))
+	fmt.Printf("Issued: %d of %d (%.4f%%)\n", issued, maxSupply, float64(issued)*100/float64(maxSupply))
+	fmt.Println()
+
+	schedule := block.EmissionSchedule()
+	fmt.Println("Schedule:")
+	for _, era := range schedule {
+		current := ""
+		if height+1 >= era.StartHeight && height+1 <= era.EndHeight {
+			current = " <- next block"
+		}
+		fmt.Printf("  blocks %d-%d pay %d, %d issued by the end%s\n", era.StartHeight, era.EndHeight, era.Subsidy, era.Issued, current)
+	}
+	fmt.Printf("  blocks after %d only pay fees\n", schedule[len(schedule)-1].EndHeight)
+}
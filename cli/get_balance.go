@@ -5,8 +5,8 @@ import (
 	"github.com/chezky/acoin/block"
 )
 
-func (cli *CLI) getBalance(address string) {
-	bc := block.NewBlockChain(address)
+func (cli *CLI) getBalance(address, dataDir string) {
+	bc := block.NewBlockChain(dataDir)
 	defer bc.DB.Close()
 	UTXOSet := block.UTXOSet{Blockchain: bc}
 
@@ -6,8 +6,9 @@ import (
 	"strconv"
 )
 
-func (cli *CLI) printChain() {
-	bc := block.NewBlockChain("")
+func (cli *CLI) printChain(dataDir string) {
+	bc := block.NewBlockChain(dataDir)
+	defer bc.DB.Close()
 	itr := bc.Iterator()
 
 	for {
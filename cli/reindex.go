@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/chezky/acoin/block"
+	"os"
+)
+
+// reindex rebuilds the UTXO set from the blocks of the main chain. With txIndex it also rebuilds the transaction index, without it the
+// transaction index is deleted.
+func (cli *CLI) reindex(txIndex bool, dataDir string) {
+	bc := block.NewBlockChain(dataDir)
+	defer bc.DB.Close()
+
+	// the transaction index is dropped first, so that the UTXO set's reindex doesn't rebuild it as well
+	err := bc.DropTxIndex()
+	if err != nil {
+		fmt.Println("error deleting the transaction index", err)
+		os.Exit(1)
+	}
+
+	UTXOSet := block.UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+	fmt.Println("Rebuilt the UTXO set")
+
+	if txIndex {
+		count, err := bc.ReindexTransactions()
+		if err != nil {
+			fmt.Println("error building the transaction index", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Indexed %d transactions\n", count)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type CLI struct{}
@@ -15,12 +16,33 @@ func (cli *CLI) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	emissionCmd := flag.NewFlagSet("emission", flag.ExitOnError)
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
 
 	createChainAddress := createChainCmd.String("address", "", "Address to which initial chain should belong to")
 	createBalanceAddress := getBalanceCmd.String("address", "", "Address to which balance you would like to check")
 	createSendFrom := sendCmd.String("from", "", "Address to whom this money is coming from")
 	createSendTo := sendCmd.String("to", "", "Address to whom this money is being sent to")
 	createSendAmount := sendCmd.String("amount", "", "Amount of money being sent")
+	createSendFee := sendCmd.Int("fee", 0, "Fee paid to the miner of the block the transaction ends up in. With -mine, that's the sender")
+	createSendMine := sendCmd.Bool("mine", true, "Mine the transaction's block right away, with the sender as the miner. -mine=false sends it to -node instead")
+	createSendNode := sendCmd.String("node", "localhost:3000", "Node the transaction is sent to with -mine=false")
+	startNodePort := startNodeCmd.String("port", "", "Port the node listens on. It's also the node's ID")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining, and send the rewards to this address")
+	startNodeSeeds := startNodeCmd.String("seeds", "localhost:3000", "Comma separated list of nodes to connect to")
+	startNodeThreads := startNodeCmd.Int("threads", 0, "Number of threads to mine with. 0 uses every core")
+	reindexTxIndex := reindexCmd.Bool("txindex", true, "Build the transaction index. -txindex=false deletes it")
+
+	// every command works on the chain and wallets stored in a data directory, so that many nodes can run on one machine
+	createChainDataDir := dataDirFlag(createChainCmd)
+	printChainDataDir := dataDirFlag(printChainCmd)
+	getBalanceDataDir := dataDirFlag(getBalanceCmd)
+	sendDataDir := dataDirFlag(sendCmd)
+	createWalletDataDir := dataDirFlag(createWalletCmd)
+	startNodeDataDir := dataDirFlag(startNodeCmd)
+	emissionDataDir := dataDirFlag(emissionCmd)
+	reindexDataDir := dataDirFlag(reindexCmd)
 
 	switch os.Args[1] {
 	case "createchain":
@@ -48,6 +70,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			panic(err)
 		}
+	case "startnode":
+		err := startNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "emission":
+		err := emissionCmd.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "reindex":
+		err := reindexCmd.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
 	default:
 		os.Exit(1)
 	}
@@ -57,7 +94,7 @@ func (cli *CLI) Run() {
 			createChainCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createChain(*createChainAddress)
+		cli.createChain(*createChainAddress, *createChainDataDir)
 	}
 
 	if getBalanceCmd.Parsed() {
@@ -65,11 +102,11 @@ func (cli *CLI) Run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*createBalanceAddress)
+		cli.getBalance(*createBalanceAddress, *getBalanceDataDir)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		cli.printChain(*printChainDataDir)
 	}
 
 	if sendCmd.Parsed() {
@@ -82,9 +119,40 @@ func (cli *CLI) Run() {
 			fmt.Println("Amount must be a number")
 			os.Exit(1)
 		}
-		cli.send(*createSendFrom, *createSendTo, amt)
+		if *createSendFee < 0 {
+			fmt.Println("Fee can't be negative")
+			os.Exit(1)
+		}
+		cli.send(*createSendFrom, *createSendTo, amt, *createSendFee, *createSendMine, *createSendNode, *sendDataDir)
 	}
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		cli.createWallet(*createWalletDataDir)
+	}
+
+	if emissionCmd.Parsed() {
+		cli.emission(*emissionDataDir)
 	}
-}
\ No newline at end of file
+
+	if reindexCmd.Parsed() {
+		cli.reindex(*reindexTxIndex, *reindexDataDir)
+	}
+
+	if startNodeCmd.Parsed() {
+		if *startNodePort == "" {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		var seeds []string
+		for _, seed := range strings.Split(*startNodeSeeds, ",") {
+			if seed = strings.TrimSpace(seed); seed != "" {
+				seeds = append(seeds, seed)
+			}
+		}
+		cli.startNode(*startNodePort, *startNodeMiner, *startNodeDataDir, seeds, *startNodeThreads)
+	}
+}
+
+// dataDirFlag adds a -datadir flag to a command.
+func dataDirFlag(cmd *flag.FlagSet) *string {
+	return cmd.String("datadir", ".", "Directory the blockchain and wallets are stored in")
+}
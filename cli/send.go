@@ -6,7 +6,10 @@ import (
 	"os"
 )
 
-func (cli *CLI) send(from, to string, amount int) {
+// send makes a transaction from one address to another. With mine, the block it's in is mined right here, with the sender as the miner, so
+// the fee goes back to the sender. Otherwise the transaction is sent to the node listening on node, where it waits in the mempool until a
+// miner picks it.
+func (cli *CLI) send(from, to string, amount, fee int, mine bool, node, dataDir string) {
 
 	if !block.ValidateAddress(from) {
 		fmt.Println("The sender address is invalid")
@@ -18,16 +21,27 @@ func (cli *CLI) send(from, to string, amount int) {
 		os.Exit(1)
 	}
 
-	bc := block.NewBlockChain(from)
+	bc := block.NewBlockChain(dataDir)
 	defer bc.DB.Close()
 
 	UTXOSet := block.UTXOSet{Blockchain: bc}
 
-	tx := block.NewUTXOTransaction(from, to, amount, &UTXOSet)
-	cbTx := block.NewCoinbaseTX(from, "")
+	tx := block.NewUTXOTransaction(from, to, amount, fee, &UTXOSet)
+
+	if !mine {
+		err := block.SendTransaction(node, tx); if err != nil {
+			fmt.Println("error sending the transaction to", node, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Sent transaction %x to %s\n", tx.ID, node)
+		return
+	}
+
+	// the block is mined right here, so the sender is the miner, and gets the fee back
+	cbTx := block.NewCoinbaseTX(from, "", bc.GetBestHeight()+1, fee)
 	txs := []*block.Transaction{cbTx, tx}
 
-	newBlock := bc.MineBlock(txs)
-	UTXOSet.Update(newBlock)
+	// the block is connected to the UTXO set along with being stored
+	bc.MineBlock(txs)
 	fmt.Println("Success!")
 }
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/chezky/acoin/block"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func (cli *CLI) startNode(nodeID, minerAddress, dataDir string, seeds []string, threads int) {
+	fmt.Printf("Starting node %s\n", nodeID)
+
+	if minerAddress != "" {
+		if !block.ValidateAddress(minerAddress) {
+			fmt.Println("The miner address is invalid")
+			os.Exit(1)
+		}
+		fmt.Printf("Mining is on. Address to receive rewards: %s\n", minerAddress)
+	}
+
+	// stop the node cleanly on ctrl+c, so that the db is closed properly
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Println("Shutting down...")
+		cancel()
+	}()
+
+	node := block.NewNode(block.Config{
+		NodeID:       nodeID,
+		MinerAddress: minerAddress,
+		DataDir:      dataDir,
+		Seeds:        seeds,
+		MinerThreads: threads,
+		OnHashrate: func(hashesPerSecond float64) {
+			fmt.Printf("Mining at %.0f hashes/s\n", hashesPerSecond)
+		},
+	})
+	err := node.Start(ctx)
+	if err != nil {
+		fmt.Println("error starting node", err)
+		os.Exit(1)
+	}
+
+	<-node.Done()
+	fmt.Println("Node stopped")
+}